@@ -11,16 +11,33 @@
 //	     "nwkSEncKey": "d83cb057cebd2c43e21f4cde01c19ae1",
 //	   }
 //	}
+//
+// Devices using Over-The-Air Activation (OTAA) provide an 'appKey' (and optionally
+// 'nwkKey' and 'joinEUI') instead of the ABP 'devAddr', 'appSKey' and 'nwkSEncKey':
+//
+//	{
+//	  "lorawan": {
+//	     "devEUI": "AA555A0026011d87",
+//	     "profile": "WaziDev",
+//	     "joinEUI": "0000000000000000",
+//	     "appKey": "23158d3bbc31e6af670d195b5aed5525",
+//	   }
+//	}
 package main
 
 import (
 	_ "embed"
+	"flag"
 	"fmt"
 	"log"
+	"net/url"
 	"os"
+	"path/filepath"
+	"strconv"
 	"time"
 
 	"github.com/Waziup/wazigate-lora/internal/app"
+	"github.com/Waziup/wazigate-lora/internal/pkg/codec"
 	"github.com/Waziup/wazigate-lora/internal/pkg/waziapp"
 	"github.com/Waziup/wazigate-lora/internal/pkg/wazigate"
 )
@@ -39,6 +56,21 @@ func main() {
 		return
 	}
 
+	if len(os.Args) >= 2 && os.Args[1] == "export" {
+		// Export the device inventory from the running service, see the README.
+		flags := flag.NewFlagSet("export", flag.ExitOnError)
+		format := flags.String("format", "json", "output format: json or csv")
+		keys := flags.Bool("keys", false, "include the LoRaWAN keys")
+		flags.Parse(os.Args[2:])
+		query := url.Values{}
+		query.Set("format", *format)
+		query.Set("keys", strconv.FormatBool(*keys))
+		if err := waziapp.Get("/export?"+query.Encode(), os.Stdout); err != nil {
+			log.Fatalf("Export failed: %v", err)
+		}
+		return
+	}
+
 	////////////////////
 
 	if err := waziapp.ProvidePackageJSON(packageJSON); err != nil {
@@ -51,6 +83,16 @@ func main() {
 		log.Fatalf("Can not read config: %v", err)
 	}
 
+	if err := app.LoadRegistry(); err != nil {
+		log.Printf("Err Can not load device registry: %v", err)
+	}
+
+	if err := app.LoadUplinkQueue(); err != nil {
+		log.Printf("Err Can not load uplink queue: %v", err)
+	}
+
+	codec.ScriptDir = filepath.Join(waziapp.Dir, "codecs")
+
 	if err := wazigate.Connect(); err != nil {
 		log.Fatalf("Can not connect to WaziGate: %v", err)
 	}
@@ -88,6 +130,10 @@ func main() {
 		time.Sleep(time.Second * 5)
 	}
 
+	go app.RunReconciler()
+	go app.RunUplinkQueue()
+	go app.RunDownlinkExpiry()
+
 	for {
 		app.InitDevice()
 		err := app.Serve()
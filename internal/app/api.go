@@ -3,7 +3,10 @@ package app
 import (
 	"context"
 	"encoding/json"
+	"log"
 	"net/http"
+	"strconv"
+	"strings"
 
 	"github.com/Waziup/wazigate-lora/internal/pkg/waziapp"
 	asAPI "github.com/chirpstack/chirpstack/api/go/v4/api"
@@ -41,6 +44,67 @@ func serveAPI(resp http.ResponseWriter, req *http.Request) {
 			serveJSON(resp, r.DevAddr)
 			return
 		}
+	case "/import":
+		if req.Method == http.MethodPost {
+			var rows []ImportRow
+			var err error
+			if strings.HasPrefix(req.Header.Get("Content-Type"), "text/csv") {
+				rows, err = readImportCSV(req.Body)
+			} else {
+				rows, err = readImportJSON(req.Body)
+			}
+			if err != nil {
+				serveError(resp, err)
+				return
+			}
+			serveJSON(resp, importDevices(rows))
+			return
+		}
+	case "/export":
+		if req.Method == http.MethodGet {
+			query := req.URL.Query()
+			rows, err := exportDevices(query.Get("keys") == "true")
+			if err != nil {
+				serveError(resp, err)
+				return
+			}
+			if query.Get("format") == "csv" {
+				resp.Header().Set("Content-Type", "text/csv; charset=utf-8")
+				if err := writeExportCSV(resp, rows); err != nil {
+					log.Printf("Err Export: can not write CSV: %v", err)
+				}
+				return
+			}
+			serveJSON(resp, rows)
+			return
+		}
+	case "/reconcile":
+		switch req.Method {
+		case http.MethodGet:
+			serveJSON(resp, LastReconcileReport())
+			return
+		case http.MethodPost:
+			serveJSON(resp, Reconcile())
+			return
+		}
+	case "/uplinks":
+		switch req.Method {
+		case http.MethodGet:
+			limit := 100
+			if l, err := strconv.Atoi(req.URL.Query().Get("limit")); err == nil && l >= 0 {
+				limit = l
+			}
+			serveJSON(resp, uplinkQueue.Status(limit))
+			return
+		case http.MethodDelete:
+			serveJSON(resp, uplinkQueue.Clear())
+			return
+		}
+	case "/dutycycle":
+		if req.Method == http.MethodGet {
+			serveJSON(resp, GetDutyCycleStatus())
+			return
+		}
 	case "/profiles":
 		switch req.Method {
 		case http.MethodGet:
@@ -84,11 +148,144 @@ func serveAPI(resp http.ResponseWriter, req *http.Request) {
 			}
 			return
 		}
+	case "/multicast":
+		switch req.Method {
+		case http.MethodGet:
+			groups, err := listMulticastGroups()
+			if err != nil {
+				serveError(resp, err)
+				return
+			}
+			serveJSON(resp, groups)
+			return
+		case http.MethodPost:
+			var group MulticastGroup
+			if err := json.NewDecoder(req.Body).Decode(&group); err != nil {
+				serveError(resp, err)
+				return
+			}
+			id, err := createMulticastGroup(&group)
+			if err != nil {
+				serveError(resp, err)
+				return
+			}
+			serveJSON(resp, map[string]string{"id": id})
+			return
+		}
+	default:
+		// Path: /multicast/{group ID or name}[/keys|/queue|/devices/{device ID or DevEUI}]
+		if path := strings.TrimPrefix(req.URL.Path, "/multicast/"); path != req.URL.Path {
+			if serveMulticast(resp, req, strings.Split(path, "/")) {
+				return
+			}
+		}
+		// Path: /queue/{device ID or DevEUI}
+		if id := strings.TrimPrefix(req.URL.Path, "/queue/"); id != req.URL.Path {
+			entry, err := queueDevice(id)
+			if err != nil {
+				resp.WriteHeader(http.StatusNotFound)
+				resp.Write([]byte(err.Error()))
+				return
+			}
+			switch req.Method {
+			case http.MethodGet:
+				queue, err := getDeviceQueue(entry)
+				if err != nil {
+					serveError(resp, err)
+					return
+				}
+				serveJSON(resp, queue)
+				return
+			case http.MethodDelete:
+				if err := flushDeviceQueue(entry); err != nil {
+					serveError(resp, err)
+					return
+				}
+				resp.WriteHeader(http.StatusNoContent)
+				return
+			case http.MethodPost:
+				var downlink DownlinkRequest
+				if err := json.NewDecoder(req.Body).Decode(&downlink); err != nil {
+					serveError(resp, err)
+					return
+				}
+				id, err := enqueueRawDownlink(entry, &downlink)
+				if err != nil {
+					serveError(resp, err)
+					return
+				}
+				serveJSON(resp, map[string]string{"id": id})
+				return
+			}
+		}
 	}
 
 	serveStatic(resp, req)
 }
 
+// serveMulticast serves the requests of a multicast group and tells if the path and
+// method are known.
+func serveMulticast(resp http.ResponseWriter, req *http.Request, path []string) bool {
+	id, err := resolveMulticastGroup(path[0])
+	if err != nil {
+		resp.WriteHeader(http.StatusNotFound)
+		resp.Write([]byte(err.Error()))
+		return true
+	}
+	switch {
+	case len(path) == 1 && req.Method == http.MethodGet:
+		group, err := getMulticastGroup(id)
+		if err != nil {
+			serveError(resp, err)
+			return true
+		}
+		serveJSON(resp, group)
+	case len(path) == 1 && req.Method == http.MethodDelete:
+		if err := deleteMulticastGroup(id); err != nil {
+			serveError(resp, err)
+			return true
+		}
+		resp.WriteHeader(http.StatusNoContent)
+	case len(path) == 2 && path[1] == "keys" && req.Method == http.MethodPut:
+		var keys MulticastKeys
+		if err := json.NewDecoder(req.Body).Decode(&keys); err != nil {
+			serveError(resp, err)
+			return true
+		}
+		if err := setMulticastKeys(id, &keys); err != nil {
+			serveError(resp, err)
+			return true
+		}
+		resp.WriteHeader(http.StatusNoContent)
+	case len(path) == 3 && path[1] == "devices" && (req.Method == http.MethodPost || req.Method == http.MethodDelete):
+		if err := setMulticastDevice(id, path[2], req.Method == http.MethodPost); err != nil {
+			serveError(resp, err)
+			return true
+		}
+		resp.WriteHeader(http.StatusNoContent)
+	case len(path) == 2 && path[1] == "queue" && req.Method == http.MethodPost:
+		var downlink DownlinkRequest
+		if err := json.NewDecoder(req.Body).Decode(&downlink); err != nil {
+			serveError(resp, err)
+			return true
+		}
+		data, err := downlink.payload()
+		if err != nil {
+			serveError(resp, err)
+			return true
+		}
+		fCnt, err := enqueueMulticast(id, downlink.FPort, data)
+		if err != nil {
+			serveError(resp, err)
+			return true
+		}
+		serveJSON(resp, map[string]uint32{"fCnt": fCnt})
+	default:
+		return false
+	}
+	return true
+}
+
 func serveError(resp http.ResponseWriter, err error) {
 	resp.Header().Set("Content-Type", "text/plain")
 	resp.WriteHeader(http.StatusInternalServerError)
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"strings"
 
 	asAPI "github.com/chirpstack/chirpstack/api/go/v4/api"
 	"github.com/chirpstack/chirpstack/api/go/v4/common"
@@ -234,18 +235,10 @@ func InitChirpstack() error {
 		asDeviceProfileService := asAPI.NewDeviceProfileServiceClient(conn)
 		for i, deviceProfile := range Config.DeviceProfiles {
 			if deviceProfile.Id == "" {
-				deviceProfile := asAPI.DeviceProfile{
-					Name:                "Wazidev",
-					TenantId:            Config.Tenant.Id,
-					MacVersion:          common.MacVersion_LORAWAN_1_0_1,
-					RegParamsRevision:   common.RegParamsRevision_A,
-					Region:              common.Region_EU868,
-					PayloadCodecRuntime: asAPI.CodecRuntime_CAYENNE_LPP,
-					PayloadCodecScript:  "CAYENNE_LPP",
-				}
+				deviceProfile := newDeviceProfileWaziDev()
 
 				resp, err := asDeviceProfileService.Create(ctx, &asAPI.CreateDeviceProfileRequest{
-					DeviceProfile: &deviceProfile,
+					DeviceProfile: deviceProfile,
 				})
 				if err != nil {
 					return fmt.Errorf("err grpc: can not create device-profile: %v", err)
@@ -261,17 +254,9 @@ func InitChirpstack() error {
 				if err != nil {
 					if status.Code(err) == codes.NotFound {
 						log.Printf("Device-profile id %q does not exist!", deviceProfile.Id)
-						deviceProfile := asAPI.DeviceProfile{
-							Name:                "Wazidev",
-							TenantId:            Config.Tenant.Id,
-							MacVersion:          common.MacVersion_LORAWAN_1_0_1,
-							RegParamsRevision:   common.RegParamsRevision_A,
-							Region:              common.Region_EU868,
-							PayloadCodecRuntime: asAPI.CodecRuntime_CAYENNE_LPP,
-							PayloadCodecScript:  "CAYENNE_LPP",
-						}
+						deviceProfile := newDeviceProfileWaziDev()
 						resp, err := asDeviceProfileService.Create(ctx, &asAPI.CreateDeviceProfileRequest{
-							DeviceProfile: &deviceProfile,
+							DeviceProfile: deviceProfile,
 						})
 						if err != nil {
 							return fmt.Errorf("grpc: can not create device-profile: %v", err)
@@ -283,6 +268,17 @@ func InitChirpstack() error {
 					} else {
 						return fmt.Errorf("grpc: can not get device-profile: %v", err)
 					}
+				} else if !resp.DeviceProfile.SupportsOtaa {
+					// Profiles created by older versions do not support OTAA.
+					deviceProfile := resp.DeviceProfile
+					deviceProfile.SupportsOtaa = true
+					_, err := asDeviceProfileService.Update(ctx, &asAPI.UpdateDeviceProfileRequest{
+						DeviceProfile: deviceProfile,
+					})
+					if err != nil {
+						return fmt.Errorf("grpc: can not update device-profile: %v", err)
+					}
+					log.Printf("Device-profile %q has been updated to support OTAA.", deviceProfile.Name)
 				} else {
 					log.Printf("Device-profile %q OK.", resp.DeviceProfile.Name)
 				}
@@ -292,9 +288,92 @@ func InitChirpstack() error {
 	return nil
 }
 
+// newDeviceProfileWaziDev returns the built-in "Wazidev" device profile.
+func newDeviceProfileWaziDev() *asAPI.DeviceProfile {
+	return &asAPI.DeviceProfile{
+		Name:                "Wazidev",
+		TenantId:            Config.Tenant.Id,
+		MacVersion:          common.MacVersion_LORAWAN_1_0_1,
+		RegParamsRevision:   common.RegParamsRevision_A,
+		Region:              common.Region_EU868,
+		SupportsOtaa:        true,
+		PayloadCodecRuntime: asAPI.CodecRuntime_CAYENNE_LPP,
+		PayloadCodecScript:  "CAYENNE_LPP",
+	}
+}
+
 ////////////////////////////////////////////////////////////////////////////////
 
-func setDeviceProfileWaziDev(devEUI string, id string) error {
+// resolveDeviceProfile finds a device profile of the tenant by its ID or name.
+// "WaziDev" always resolves to the built-in device profile.
+func resolveDeviceProfile(profile string) (*asAPI.DeviceProfile, error) {
+	ctx := context.Background()
+
+	conn, err := connectToChirpStack()
+	if err != nil {
+		return nil, fmt.Errorf("grpc: can not connect to ChirpStack: %v", err)
+	}
+	defer conn.Close()
+
+	deviceProfileService := asAPI.NewDeviceProfileServiceClient(conn)
+	deviceProfileId := ""
+	if profile == "WaziDev" && len(Config.DeviceProfiles) != 0 {
+		deviceProfileId = Config.DeviceProfiles[0].Id
+	} else {
+		resp, err := deviceProfileService.List(ctx, &asAPI.ListDeviceProfilesRequest{
+			Limit:    1000,
+			TenantId: Config.Tenant.Id,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("grpc: can not list device-profiles: %v", err)
+		}
+		names := make([]string, len(resp.Result))
+		for i, deviceProfile := range resp.Result {
+			names[i] = deviceProfile.Name
+			if deviceProfile.Id == profile {
+				deviceProfileId = deviceProfile.Id
+				break
+			}
+			if deviceProfileId == "" && strings.EqualFold(deviceProfile.Name, profile) {
+				deviceProfileId = deviceProfile.Id
+			}
+		}
+		if deviceProfileId == "" {
+			return nil, fmt.Errorf("unknown device-profile %q, known profiles are: %q", profile, names)
+		}
+	}
+
+	resp, err := deviceProfileService.Get(ctx, &asAPI.GetDeviceProfileRequest{
+		Id: deviceProfileId,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("grpc: can not get device-profile %q: %v", profile, err)
+	}
+	return resp.DeviceProfile, nil
+}
+
+// getDeviceProfile returns the device profile with the ID.
+func getDeviceProfile(id string) (*asAPI.DeviceProfile, error) {
+	conn, err := connectToChirpStack()
+	if err != nil {
+		return nil, fmt.Errorf("grpc: can not connect to ChirpStack: %v", err)
+	}
+	defer conn.Close()
+
+	deviceProfileService := asAPI.NewDeviceProfileServiceClient(conn)
+	resp, err := deviceProfileService.Get(context.Background(), &asAPI.GetDeviceProfileRequest{
+		Id: id,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("grpc: can not get device-profile %q: %v", id, err)
+	}
+	return resp.DeviceProfile, nil
+}
+
+// setDevice creates or updates the ChirpStack device of a Wazigate device.
+// Only the DevEUI, JoinEUI, device-profile and frame-counter check are taken from
+// the given device, the name and description of existing devices are kept.
+func setDevice(id string, device *asAPI.Device) error {
 	ctx := context.Background()
 
 	conn, err := connectToChirpStack()
@@ -303,20 +382,20 @@ func setDeviceProfileWaziDev(devEUI string, id string) error {
 	}
 	defer conn.Close()
 
-	deviceProfileId := Config.DeviceProfiles[0].Id
 	deviceClient := asAPI.NewDeviceServiceClient(conn)
 	resp, err := deviceClient.Get(ctx, &asAPI.GetDeviceRequest{
-		DevEui: devEUI,
+		DevEui: device.DevEui,
 	})
 	if status.Code(err) == codes.NotFound {
 		_, err := deviceClient.Create(ctx, &asAPI.CreateDeviceRequest{
 			Device: &asAPI.Device{
-				DevEui:          devEUI,
-				Name:            devEUI,
+				DevEui:          device.DevEui,
+				Name:            device.DevEui,
 				Description:     fmt.Sprintf("Automatically created for Waziup device %q.\nDO NOT DELETE!", id),
-				DeviceProfileId: deviceProfileId,
+				DeviceProfileId: device.DeviceProfileId,
 				ApplicationId:   Config.Application.Id,
-				SkipFcntCheck:   true,
+				SkipFcntCheck:   device.SkipFcntCheck,
+				JoinEui:         device.JoinEui,
 			},
 		})
 		if err == nil {
@@ -330,17 +409,23 @@ func setDeviceProfileWaziDev(devEUI string, id string) error {
 		log.Printf("Err Can not read Chirpstack device: %v", err)
 		return err
 	}
-	if resp.Device.DeviceProfileId == deviceProfileId {
+	if resp.Device.DeviceProfileId == device.DeviceProfileId &&
+		resp.Device.JoinEui == device.JoinEui &&
+		resp.Device.SkipFcntCheck == device.SkipFcntCheck &&
+		!resp.Device.IsDisabled {
 		return nil
 	}
 	_, err = deviceClient.Update(ctx, &asAPI.UpdateDeviceRequest{
 		Device: &asAPI.Device{
-			DevEui:          devEUI,
+			DevEui:          device.DevEui,
 			ApplicationId:   Config.Application.Id,
-			DeviceProfileId: deviceProfileId,
+			DeviceProfileId: device.DeviceProfileId,
 			Name:            resp.Device.Name,
 			Description:     resp.Device.Description,
-			SkipFcntCheck:   true,
+			SkipFcntCheck:   device.SkipFcntCheck,
+			JoinEui:         device.JoinEui,
+			Variables:       resp.Device.Variables,
+			Tags:            resp.Device.Tags,
 		},
 	})
 	if err == nil {
@@ -351,7 +436,49 @@ func setDeviceProfileWaziDev(devEUI string, id string) error {
 	return err
 }
 
-func setWaziDevActivation(devEUI string, devAddr string, nwkSEncKey string, appSKey string) error {
+// frameCounters are the uplink and downlink frame counters of a device, nil if not set.
+type frameCounters struct {
+	up   *uint32
+	down *uint32
+}
+
+func (fCnt frameCounters) isSet() bool {
+	return fCnt.up != nil || fCnt.down != nil
+}
+
+func (fCnt frameCounters) equal(other frameCounters) bool {
+	equal := func(a *uint32, b *uint32) bool {
+		return (a == nil && b == nil) || (a != nil && b != nil && *a == *b)
+	}
+	return equal(fCnt.up, other.up) && equal(fCnt.down, other.down)
+}
+
+// diff returns the counters of fCnt that are set and differ from last.
+func (fCnt frameCounters) diff(last frameCounters) (changed frameCounters) {
+	if fCnt.up != nil && (last.up == nil || *last.up != *fCnt.up) {
+		changed.up = fCnt.up
+	}
+	if fCnt.down != nil && (last.down == nil || *last.down != *fCnt.down) {
+		changed.down = fCnt.down
+	}
+	return
+}
+
+func (fCnt frameCounters) apply(activation *asAPI.DeviceActivation) {
+	if fCnt.up != nil {
+		activation.FCntUp = *fCnt.up
+	}
+	if fCnt.down != nil {
+		activation.NFCntDown = *fCnt.down
+		activation.AFCntDown = *fCnt.down
+	}
+}
+
+// setWaziDevActivation activates a device by personalization (ABP) if it is not
+// activated yet, if the session keys changed or if fCnt sets new frame counters.
+// A new session (new DevAddr or session keys) starts at the counters of fCnt, or 0.
+// Otherwise the current counters are kept, unless fCnt changed since last.
+func setWaziDevActivation(activation *asAPI.DeviceActivation, fCnt frameCounters, last frameCounters) error {
 	ctx := context.Background()
 
 	conn, err := connectToChirpStack()
@@ -362,52 +489,33 @@ func setWaziDevActivation(devEUI string, devAddr string, nwkSEncKey string, appS
 
 	deviceClient := asAPI.NewDeviceServiceClient(conn)
 	r, err := deviceClient.GetActivation(ctx, &asAPI.GetDeviceActivationRequest{
-		DevEui: devEUI,
+		DevEui: activation.DevEui,
 	})
-	//log.Printf("Err: %v", err)
-	if err == nil {
-		//log.Printf("Error is nill!!!!!")
+	if err != nil {
+		log.Printf("Err Can not get Chirpstack device activation: %v", err)
+		return err
+	}
+	if r.DeviceActivation == nil || !sameSessionKeys(r.DeviceActivation, activation) {
+		fCnt.apply(activation)
 		_, err = deviceClient.Activate(ctx, &asAPI.ActivateDeviceRequest{
-			DeviceActivation: &asAPI.DeviceActivation{
-				DevEui:      devEUI,
-				DevAddr:     devAddr,
-				AppSKey:     appSKey,
-				NwkSEncKey:  nwkSEncKey,
-				SNwkSIntKey: nwkSEncKey,
-				FNwkSIntKey: nwkSEncKey,
-				FCntUp:      0,
-				NFCntDown:   0,
-				AFCntDown:   0,
-			},
+			DeviceActivation: activation,
 		})
 		if err == nil {
-			log.Println("Activating Chirpstack device ... OK")
+			log.Println("Activating Chirpstack device (new session) ... OK")
 		} else {
 			log.Printf("Err Can not activate Chirpstack device: %v", err)
 		}
 		return err
 	}
-	if err != nil {
-		log.Printf("Err Can not get Chirpstack device activation: %v", err)
-		return err
-	}
-	if r.DeviceActivation.DevEui != devEUI ||
-		r.DeviceActivation.DevAddr != devAddr ||
-		r.DeviceActivation.AppSKey != appSKey ||
-		r.DeviceActivation.NwkSEncKey != nwkSEncKey {
-
+	if changed := fCnt.diff(last); changed.isSet() {
+		// Same session: keep counting where the device is, except for the counters
+		// changed in the metadata.
+		activation.FCntUp = r.DeviceActivation.FCntUp
+		activation.NFCntDown = r.DeviceActivation.NFCntDown
+		activation.AFCntDown = r.DeviceActivation.AFCntDown
+		changed.apply(activation)
 		_, err = deviceClient.Activate(ctx, &asAPI.ActivateDeviceRequest{
-			DeviceActivation: &asAPI.DeviceActivation{
-				DevEui:      devEUI,
-				DevAddr:     devAddr,
-				AppSKey:     appSKey,
-				NwkSEncKey:  nwkSEncKey,
-				SNwkSIntKey: nwkSEncKey,
-				FNwkSIntKey: nwkSEncKey,
-				FCntUp:      0,
-				NFCntDown:   0,
-				AFCntDown:   0,
-			},
+			DeviceActivation: activation,
 		})
 		if err == nil {
 			log.Println("Reactivating Chirpstack device ... OK")
@@ -419,6 +527,123 @@ func setWaziDevActivation(devEUI string, devAddr string, nwkSEncKey string, appS
 	return nil
 }
 
+// sameSessionKeys compares the DevAddr and session keys of two ABP activations.
+func sameSessionKeys(a *asAPI.DeviceActivation, b *asAPI.DeviceActivation) bool {
+	return strings.EqualFold(a.DevEui, b.DevEui) &&
+		strings.EqualFold(a.DevAddr, b.DevAddr) &&
+		strings.EqualFold(a.AppSKey, b.AppSKey) &&
+		strings.EqualFold(a.NwkSEncKey, b.NwkSEncKey) &&
+		strings.EqualFold(a.SNwkSIntKey, b.SNwkSIntKey) &&
+		strings.EqualFold(a.FNwkSIntKey, b.FNwkSIntKey)
+}
+
+// removeChirpstackDevice deletes or disables (see Config.RemoveDevices) a ChirpStack device.
+func removeChirpstackDevice(devEUI string) error {
+	ctx := context.Background()
+
+	conn, err := connectToChirpStack()
+	if err != nil {
+		return fmt.Errorf("grpc: can not connect to ChirpStack: %v", err)
+	}
+	defer conn.Close()
+
+	deviceClient := asAPI.NewDeviceServiceClient(conn)
+
+	if Config.RemoveDevices == RemoveDevicesDisable {
+		resp, err := deviceClient.Get(ctx, &asAPI.GetDeviceRequest{
+			DevEui: devEUI,
+		})
+		if status.Code(err) == codes.NotFound {
+			return nil
+		}
+		if err != nil {
+			log.Printf("Err Can not read Chirpstack device: %v", err)
+			return err
+		}
+		if resp.Device.IsDisabled {
+			return nil
+		}
+		resp.Device.IsDisabled = true
+		_, err = deviceClient.Update(ctx, &asAPI.UpdateDeviceRequest{
+			Device: resp.Device,
+		})
+		if err == nil {
+			log.Println("Disabling Chirpstack device ... OK")
+		} else {
+			log.Printf("Err Can not disable Chirpstack device: %v", err)
+		}
+		return err
+	}
+
+	_, err = deviceClient.Delete(ctx, &asAPI.DeleteDeviceRequest{
+		DevEui: devEUI,
+	})
+	if status.Code(err) == codes.NotFound {
+		return nil
+	}
+	if err == nil {
+		log.Println("Deleting Chirpstack device ... OK")
+	} else {
+		log.Printf("Err Can not delete Chirpstack device: %v", err)
+	}
+	return err
+}
+
+// setWaziDevKeys creates or updates the OTAA root keys of a device.
+// For LoRaWAN 1.0.x devices nwkKey is empty and the appKey is stored as
+// ChirpStack's NwkKey, as that is where ChirpStack expects the 1.0.x AppKey.
+func setWaziDevKeys(devEUI string, nwkKey string, appKey string) error {
+	ctx := context.Background()
+
+	conn, err := connectToChirpStack()
+	if err != nil {
+		return fmt.Errorf("grpc: can not connect to ChirpStack: %v", err)
+	}
+	defer conn.Close()
+
+	keys := &asAPI.DeviceKeys{
+		DevEui: devEUI,
+		NwkKey: appKey,
+	}
+	if nwkKey != "" {
+		keys.NwkKey = nwkKey
+		keys.AppKey = appKey
+	}
+
+	deviceClient := asAPI.NewDeviceServiceClient(conn)
+	r, err := deviceClient.GetKeys(ctx, &asAPI.GetDeviceKeysRequest{
+		DevEui: devEUI,
+	})
+	if status.Code(err) == codes.NotFound {
+		_, err = deviceClient.CreateKeys(ctx, &asAPI.CreateDeviceKeysRequest{
+			DeviceKeys: keys,
+		})
+		if err == nil {
+			log.Println("Creating Chirpstack device keys ... OK")
+		} else {
+			log.Printf("Err Can not create Chirpstack device keys: %v", err)
+		}
+		return err
+	}
+	if err != nil {
+		log.Printf("Err Can not get Chirpstack device keys: %v", err)
+		return err
+	}
+	if strings.EqualFold(r.DeviceKeys.NwkKey, keys.NwkKey) &&
+		strings.EqualFold(r.DeviceKeys.AppKey, keys.AppKey) {
+		return nil
+	}
+	_, err = deviceClient.UpdateKeys(ctx, &asAPI.UpdateDeviceKeysRequest{
+		DeviceKeys: keys,
+	})
+	if err == nil {
+		log.Println("Updating Chirpstack device keys ... OK")
+	} else {
+		log.Printf("Err Can not update Chirpstack device keys: %v", err)
+	}
+	return err
+}
+
 // //////////////////////////////////////////////////////////////////////////////
 
 func (a APIToken) GetRequestMetadata(ctx context.Context, url ...string) (map[string]string, error) {
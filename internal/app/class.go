@@ -0,0 +1,185 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/Waziup/wazigate-lora/internal/pkg/waziup"
+	asAPI "github.com/chirpstack/chirpstack/api/go/v4/api"
+	"github.com/golang/protobuf/proto"
+)
+
+// LoRaWAN device classes of the 'class' field of the 'lorawan' metadata.
+const (
+	// ClassA devices receive downlinks only after an uplink (default).
+	ClassA = "A"
+	// ClassB devices also receive downlinks in ping slots, synchronized by gateway beacons.
+	ClassB = "B"
+	// ClassC devices receive downlinks at any time, unless they are transmitting.
+	ClassC = "C"
+)
+
+const (
+	// defaultPingSlotPeriod is the Class B ping-slot period in seconds.
+	defaultPingSlotPeriod = 32
+	// beaconPeriod is the Class B beacon period in seconds. A beacon period has
+	// 2^k ping slots.
+	beaconPeriod = 128
+	// classCTimeout is the time in seconds ChirpStack waits for the acknowledgement
+	// of a confirmed Class C downlink.
+	classCTimeout = 5
+	// classCExpiry is the default expiry in seconds of Class C downlinks, which
+	// are sent at once unless the device is not reachable.
+	classCExpiry = 60
+)
+
+// DeviceClass is the LoRaWAN class of a device, with the ping-slot period in seconds
+// of Class B devices.
+type DeviceClass struct {
+	Class          string
+	PingSlotPeriod int
+}
+
+// deviceClass reads the 'class' and 'pingSlotPeriod' fields of the 'lorawan' metadata.
+func deviceClass(lorawan waziup.JSON) (DeviceClass, error) {
+	class := DeviceClass{Class: ClassA}
+	if s, err := lorawan.Get("class").String(); err == nil {
+		class.Class = strings.ToUpper(s)
+	}
+	switch class.Class {
+	case ClassA, ClassC:
+	case ClassB:
+		class.PingSlotPeriod = defaultPingSlotPeriod
+		if period, err := lorawan.Get("pingSlotPeriod").Int(); err == nil {
+			class.PingSlotPeriod = period
+		}
+		if _, err := pingSlotNbK(class.PingSlotPeriod); err != nil {
+			return class, err
+		}
+	default:
+		return class, fmt.Errorf("unknown class %q, must be A, B or C", class.Class)
+	}
+	return class, nil
+}
+
+// pingSlotNbK returns the ChirpStack 'k' of a ping-slot period of 1, 2, 4 .. 128 seconds.
+func pingSlotNbK(period int) (uint32, error) {
+	for k := uint32(0); k <= 7; k++ {
+		if beaconPeriod>>k == period {
+			return k, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid pingSlotPeriod %d, must be 1, 2, 4 .. 128 seconds", period)
+}
+
+// downlinkExpiry returns the default expiry in seconds of downlinks to a device class:
+// a few ping slots for Class B, a minute for Class C and none for Class A.
+func (class DeviceClass) downlinkExpiry() int {
+	switch class.Class {
+	case ClassB:
+		return 3 * class.PingSlotPeriod
+	case ClassC:
+		return classCExpiry
+	}
+	return 0
+}
+
+// supportedBy tells if a device profile supports the class.
+func (class DeviceClass) supportedBy(deviceProfile *asAPI.DeviceProfile) bool {
+	switch class.Class {
+	case ClassB:
+		k, _ := pingSlotNbK(class.PingSlotPeriod)
+		return deviceProfile.SupportsClassB && deviceProfile.ClassBPingSlotNbK == k
+	case ClassC:
+		return deviceProfile.SupportsClassC
+	}
+	return true
+}
+
+// profileName returns the name of the variant of a device profile for the class.
+func (class DeviceClass) profileName(name string) string {
+	if class.Class == ClassB {
+		return fmt.Sprintf("%s (Class B, %ds)", name, class.PingSlotPeriod)
+	}
+	return fmt.Sprintf("%s (Class %s)", name, class.Class)
+}
+
+// resolveLoRaWANProfile returns the device profile of the 'profile' and 'class' fields
+// of the 'lorawan' metadata. If the profile does not support the class, a variant of the
+// profile with the class is used, and created if it does not exist and create is set.
+func resolveLoRaWANProfile(lorawan waziup.JSON, create bool) (*asAPI.DeviceProfile, error) {
+	profile, err := lorawan.Get("profile").String()
+	if err != nil {
+		return nil, fmt.Errorf("profile: %v", err)
+	}
+	class, err := deviceClass(lorawan)
+	if err != nil {
+		return nil, err
+	}
+	deviceProfile, err := resolveDeviceProfile(profile)
+	if err != nil || class.supportedBy(deviceProfile) {
+		return deviceProfile, err
+	}
+	return classDeviceProfile(deviceProfile, class, create)
+}
+
+// classDeviceProfile finds the variant of a device profile for a class, and creates
+// it if it does not exist and create is set.
+func classDeviceProfile(base *asAPI.DeviceProfile, class DeviceClass, create bool) (*asAPI.DeviceProfile, error) {
+	ctx := context.Background()
+
+	conn, err := connectToChirpStack()
+	if err != nil {
+		return nil, fmt.Errorf("grpc: can not connect to ChirpStack: %v", err)
+	}
+	defer conn.Close()
+
+	deviceProfileService := asAPI.NewDeviceProfileServiceClient(conn)
+	name := class.profileName(base.Name)
+	resp, err := deviceProfileService.List(ctx, &asAPI.ListDeviceProfilesRequest{
+		Limit:    1000,
+		TenantId: Config.Tenant.Id,
+		Search:   name,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("grpc: can not list device-profiles: %v", err)
+	}
+	for _, deviceProfile := range resp.Result {
+		if deviceProfile.Name == name {
+			resp, err := deviceProfileService.Get(ctx, &asAPI.GetDeviceProfileRequest{
+				Id: deviceProfile.Id,
+			})
+			if err != nil {
+				return nil, fmt.Errorf("grpc: can not get device-profile %q: %v", name, err)
+			}
+			return resp.DeviceProfile, nil
+		}
+	}
+
+	if !create {
+		return nil, fmt.Errorf("the device-profile %q does not exist yet", name)
+	}
+	deviceProfile := proto.Clone(base).(*asAPI.DeviceProfile)
+	deviceProfile.Id = ""
+	deviceProfile.Name = name
+	switch class.Class {
+	case ClassB:
+		deviceProfile.SupportsClassB = true
+		deviceProfile.ClassBPingSlotNbK, _ = pingSlotNbK(class.PingSlotPeriod)
+		deviceProfile.ClassBTimeout = uint32(class.PingSlotPeriod)
+	case ClassC:
+		deviceProfile.SupportsClassC = true
+		deviceProfile.ClassCTimeout = classCTimeout
+	}
+	created, err := deviceProfileService.Create(ctx, &asAPI.CreateDeviceProfileRequest{
+		DeviceProfile: deviceProfile,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("grpc: can not create device-profile %q: %v", name, err)
+	}
+	deviceProfile.Id = created.Id
+	log.Printf("Device-profile %q has been created. ID: %v", name, deviceProfile.Id)
+	return deviceProfile, nil
+}
@@ -6,13 +6,46 @@ import (
 )
 
 var Config struct {
-	Login          asAPI.LoginRequest    `json:"login"`
-	Tenant         asAPI.Tenant          `json:"tenant"`
-	Gateway        asAPI.Gateway         `json:"gateway"`
-	Application    asAPI.Application     `json:"application"`
-	DeviceProfiles []asAPI.DeviceProfile `json:"device_profiles"`
+	Login          asAPI.LoginRequest     `json:"login"`
+	Tenant         asAPI.Tenant           `json:"tenant"`
+	Gateway        asAPI.Gateway          `json:"gateway"`
+	Application    asAPI.Application      `json:"application"`
+	DeviceProfiles []*asAPI.DeviceProfile `json:"device_profiles"`
+	// RemoveDevices is what happens to a ChirpStack device when its Wazigate device
+	// is deleted or loses its 'lorawan' metadata: "delete" (default) or "disable".
+	RemoveDevices string `json:"remove_devices,omitempty"`
+	// Reconcile configures the periodic reconciliation of Wazigate and ChirpStack devices.
+	Reconcile ReconcileConfig `json:"reconcile"`
+	// LowBattery is the default low-battery threshold in percent (default 20).
+	LowBattery int `json:"low_battery,omitempty"`
+	// UplinkQueue configures the queue of uplinks that wait for the Wazigate Edge.
+	UplinkQueue UplinkQueueConfig `json:"uplink_queue"`
+	// DutyCycle configures the airtime budget of downlinks.
+	DutyCycle DutyCycleConfig `json:"duty_cycle"`
 }
 
+type ReconcileConfig struct {
+	// Interval between two runs in seconds (default 15 minutes).
+	Interval int `json:"interval,omitempty"`
+	// Policy is "fix" or "report" per kind of drift, see DriftMissing etc.
+	Policy map[string]string `json:"policy,omitempty"`
+}
+
+type UplinkQueueConfig struct {
+	// Size is the maximum number of queued uplinks (default 10000).
+	Size int `json:"size,omitempty"`
+}
+
+type DutyCycleConfig struct {
+	// Policy is "defer" (default), "refuse" or "off", see DutyCycleDefer etc.
+	Policy string `json:"policy,omitempty"`
+}
+
+const (
+	RemoveDevicesDelete  = "delete"
+	RemoveDevicesDisable = "disable"
+)
+
 func ReadConfig() (err error) {
 	return waziapp.ReadConfig(&Config)
 }
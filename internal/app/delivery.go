@@ -0,0 +1,140 @@
+package app
+
+import (
+	"log"
+	"time"
+
+	"github.com/Waziup/wazigate-lora/internal/pkg/wazigate"
+	"github.com/Waziup/wazigate-lora/internal/pkg/waziup"
+)
+
+// Delivery states of actuator downlinks.
+const (
+	// DeliveryQueued is a downlink in the ChirpStack device queue.
+	DeliveryQueued = "queued"
+	// DeliveryTransmitted is a downlink sent by the gateway (txack).
+	DeliveryTransmitted = "transmitted"
+	// DeliveryAcknowledged is a confirmed downlink acknowledged by the device.
+	DeliveryAcknowledged = "acknowledged"
+	// DeliveryDeferred is a downlink that waits for the duty-cycle budget.
+	DeliveryDeferred = "deferred"
+	// DeliveryExpired is a downlink removed from the queue after its expiry.
+	DeliveryExpired = "expired"
+	// DeliveryFailed is a downlink that could not be enqueued, was flushed or was
+	// not acknowledged by the device.
+	DeliveryFailed = "failed"
+)
+
+// Delivery is the 'delivery' metadata of an actuator, the state of its last downlink.
+type Delivery struct {
+	ID        string    `json:"id,omitempty"`
+	State     string    `json:"state"`
+	Confirmed bool      `json:"confirmed"`
+	FCntDown  uint32    `json:"fCntDown,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	Time      time.Time `json:"time"`
+
+	deviceID   string
+	actuatorID string
+}
+
+// final tells if the delivery state will not change anymore. Unconfirmed downlinks
+// are done when they are transmitted.
+func (d *Delivery) final() bool {
+	switch d.State {
+	case DeliveryQueued, DeliveryDeferred:
+		return false
+	case DeliveryTransmitted:
+		return !d.Confirmed
+	}
+	return true
+}
+
+// trackDelivery records the delivery of a downlink enqueued for an actuator.
+// An empty ID with an error records a downlink that could not be enqueued.
+func trackDelivery(devID string, actuatorID string, id string, confirmed bool, err error) {
+	d := &Delivery{
+		ID:         id,
+		State:      DeliveryQueued,
+		Confirmed:  confirmed,
+		Time:       time.Now(),
+		deviceID:   devID,
+		actuatorID: actuatorID,
+	}
+	if dcErr, ok := err.(*DutyCycleError); ok && dcErr.Deferred {
+		d.State = DeliveryDeferred
+		d.Error = err.Error()
+	} else if err != nil {
+		d.State = DeliveryFailed
+		d.Error = err.Error()
+	} else {
+		downlinks.Lock()
+		downlinks.deliveries[id] = d
+		downlinks.Unlock()
+	}
+	setActuatorDelivery(*d)
+}
+
+// updateDelivery changes the delivery state of a tracked downlink. Downlinks not
+// enqueued for an actuator are ignored.
+func updateDelivery(id string, state string, fCntDown uint32, errMsg string) {
+	downlinks.Lock()
+	d, ok := downlinks.deliveries[id]
+	if !ok {
+		downlinks.Unlock()
+		return
+	}
+	d.State = state
+	d.Time = time.Now()
+	if fCntDown != 0 {
+		d.FCntDown = fCntDown
+	}
+	d.Error = errMsg
+	if d.final() {
+		delete(downlinks.deliveries, id)
+	}
+	delivery := *d
+	downlinks.Unlock()
+
+	setActuatorDelivery(delivery)
+}
+
+// failDeliveries marks the queued downlinks of a device as failed, e.g. when the
+// device queue is flushed.
+func failDeliveries(devID string, errMsg string) {
+	var ids []string
+	downlinks.Lock()
+	for id, d := range downlinks.deliveries {
+		if d.deviceID == devID && d.State == DeliveryQueued {
+			ids = append(ids, id)
+		}
+	}
+	downlinks.Unlock()
+
+	for _, id := range ids {
+		updateDelivery(id, DeliveryFailed, 0, errMsg)
+	}
+}
+
+// setActuatorDelivery writes the 'delivery' metadata of an actuator, keeping its other
+// metadata. A newer downlink of the same actuator is not overwritten.
+func setActuatorDelivery(d Delivery) {
+	downlinks.Lock()
+	last := downlinks.actuators[d.deviceID+"/"+d.actuatorID]
+	downlinks.Unlock()
+	if d.ID != "" && last != "" && last != d.ID {
+		return
+	}
+	meta, err := wazigate.GetActuatorMeta(d.deviceID, d.actuatorID)
+	if err != nil {
+		log.Printf("Err Can not get metadata of actuator %q: %v", d.actuatorID, err)
+		return
+	}
+	if meta == nil {
+		meta = make(waziup.Meta)
+	}
+	meta["delivery"] = d
+	if err := wazigate.SetActuatorMeta(d.deviceID, d.actuatorID, meta); err != nil {
+		log.Printf("Err Can not set delivery of actuator %q: %v", d.actuatorID, err)
+	}
+}
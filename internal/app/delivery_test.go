@@ -0,0 +1,26 @@
+package app
+
+import "testing"
+
+func TestDeliveryFinal(t *testing.T) {
+	tests := []struct {
+		state     string
+		confirmed bool
+		final     bool
+	}{
+		{DeliveryQueued, false, false},
+		{DeliveryQueued, true, false},
+		{DeliveryDeferred, false, false},
+		{DeliveryTransmitted, false, true},
+		{DeliveryTransmitted, true, false},
+		{DeliveryAcknowledged, true, true},
+		{DeliveryExpired, false, true},
+		{DeliveryFailed, true, true},
+	}
+	for _, test := range tests {
+		d := &Delivery{State: test.state, Confirmed: test.confirmed}
+		if final := d.final(); final != test.final {
+			t.Errorf("final() of %s (confirmed %v) = %v, want %v", test.state, test.confirmed, final, test.final)
+		}
+	}
+}
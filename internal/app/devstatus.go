@@ -0,0 +1,90 @@
+package app
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	asIntegr "github.com/chirpstack/chirpstack/api/go/v4/integration"
+)
+
+// Modes of the 'deviceStatus' option in the 'lorawan' metadata.
+const (
+	// DeviceStatusSensors posts the device status as values of the 'lora_battery',
+	// 'lora_external_power' and 'lora_margin' sensors, and writes the 'lorawan.battery'
+	// metadata.
+	DeviceStatusSensors = "sensors"
+	// DeviceStatusMeta only writes the 'lorawan.battery' metadata. This is the default.
+	DeviceStatusMeta = "meta"
+	// DeviceStatusOff ignores the device status.
+	DeviceStatusOff = "off"
+)
+
+const defaultLowBattery = 20
+
+// DeviceStatus is the battery and link margin reported by a device.
+type DeviceStatus struct {
+	// Level is the battery level in percent, or nil if the device can not measure it.
+	Level         *float32 `json:"level"`
+	ExternalPower bool     `json:"externalPower"`
+	// Margin is the demodulation SNR in dB of the last device-status request.
+	Margin int32 `json:"margin"`
+	// Low is set when the battery level is at or below the low-battery threshold.
+	Low  bool      `json:"low"`
+	Time time.Time `json:"time"`
+}
+
+// lowBattery returns the low-battery threshold in percent of a device.
+func lowBattery(entry RegistryEntry) float64 {
+	if threshold, err := entry.Meta().Get("lowBattery").Number(); err == nil {
+		return threshold
+	}
+	if Config.LowBattery > 0 {
+		return float64(Config.LowBattery)
+	}
+	return defaultLowBattery
+}
+
+// postDeviceStatus publishes the battery and link margin of a status event to the
+// Wazigate device, following the 'deviceStatus' option of the 'lorawan' metadata.
+func postDeviceStatus(entry RegistryEntry, statusEvt *asIntegr.StatusEvent) error {
+	mode, _ := entry.Meta().Get("deviceStatus").String()
+	if mode == "" {
+		mode = DeviceStatusMeta
+	}
+	if mode == DeviceStatusOff {
+		return nil
+	}
+
+	status := &DeviceStatus{
+		ExternalPower: statusEvt.ExternalPowerSource,
+		Margin:        statusEvt.Margin,
+		Time:          eventTime(statusEvt.Time),
+	}
+	if !statusEvt.BatteryLevelUnavailable && !statusEvt.ExternalPowerSource {
+		level := statusEvt.BatteryLevel
+		status.Level = &level
+		status.Low = float64(level) <= lowBattery(entry)
+	}
+	if status.Low {
+		log.Printf("Device %q has a low battery: %.0f%%", entry.ID, *status.Level)
+	}
+
+	switch mode {
+	case DeviceStatusSensors:
+		values := map[string]interface{}{
+			"lora_external_power": status.ExternalPower,
+			"lora_margin":         status.Margin,
+		}
+		if status.Level != nil {
+			values["lora_battery"] = *status.Level
+		}
+		if err := postSensorValues(entry.ID, values, status.Time); err != nil {
+			return err
+		}
+	case DeviceStatusMeta:
+	default:
+		return fmt.Errorf("unknown deviceStatus %q", mode)
+	}
+	return setLoRaWANMeta(entry.ID, "battery", status)
+}
@@ -0,0 +1,482 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/Waziup/wazigate-lora/internal/pkg/codec"
+	"github.com/Waziup/wazigate-lora/internal/pkg/wazigate"
+	"github.com/Waziup/wazigate-lora/internal/pkg/waziup"
+	asAPI "github.com/chirpstack/chirpstack/api/go/v4/api"
+)
+
+// Queue policies of actuator downlinks.
+const (
+	// QueueReplaceAll flushes the device queue before the downlink is enqueued.
+	QueueReplaceAll = "replace-all"
+	// QueueAppend enqueues the downlink after the queued downlinks.
+	QueueAppend = "append"
+	// QueueDedupe removes the queued downlink of the same actuator, if it has not been
+	// sent yet, and enqueues the downlink after the other queued downlinks.
+	QueueDedupe = "dedupe-per-actuator"
+)
+
+// Batch modes of the actuator values posted to 'devices/+/actuators/+/values'.
+const (
+	// BatchSequence sends each value as its own downlink, in order.
+	BatchSequence = "sequence"
+	// BatchCombined sends all values in one downlink.
+	BatchCombined = "combined"
+)
+
+const defaultDownlinkFPort = 100
+
+// DownlinkSettings are the 'downlink' settings of the 'lorawan' metadata of a device,
+// or of the metadata of an actuator.
+type DownlinkSettings struct {
+	FPort     uint32 `json:"fPort"`
+	Confirmed bool   `json:"confirmed"`
+	Queue     string `json:"queue"`
+	// Expiry in seconds removes the downlink from the queue if it has not been sent.
+	Expiry int `json:"expiry,omitempty"`
+	// Batch and Spacing (in seconds) apply to the 'values' batches of actuators.
+	Batch   string `json:"batch"`
+	Spacing int    `json:"spacing,omitempty"`
+}
+
+// downlinkSettings returns the downlink settings of an actuator. The 'downlink' actuator
+// metadata overrides the 'downlink' of the 'lorawan' metadata, which overrides the defaults.
+// Downlinks to Class B and C devices expire by default.
+func downlinkSettings(entry RegistryEntry, actuator *waziup.Actuator) (*DownlinkSettings, error) {
+	class, err := deviceClass(entry.Meta())
+	if err != nil {
+		return nil, err
+	}
+	settings := &DownlinkSettings{
+		FPort:  defaultDownlinkFPort,
+		Queue:  QueueReplaceAll,
+		Expiry: class.downlinkExpiry(),
+		Batch:  BatchSequence,
+	}
+	sources := []waziup.JSON{entry.Meta().Get("downlink")}
+	if actuator != nil {
+		sources = append(sources, actuator.Meta.Get("downlink"))
+	}
+	for _, downlink := range sources {
+		if fPort, err := downlink.Get("fPort").Int(); err == nil {
+			if fPort < 1 || fPort > 223 {
+				return nil, fmt.Errorf("invalid downlink fPort %d, must be 1..223", fPort)
+			}
+			settings.FPort = uint32(fPort)
+		}
+		if confirmed, err := downlink.Get("confirmed").Bool(); err == nil {
+			settings.Confirmed = confirmed
+		}
+		if queue, err := downlink.Get("queue").String(); err == nil {
+			switch queue {
+			case QueueReplaceAll, QueueAppend, QueueDedupe:
+				settings.Queue = queue
+			default:
+				return nil, fmt.Errorf("unknown downlink queue policy %q", queue)
+			}
+		}
+		if expiry, err := downlink.Get("expiry").Int(); err == nil {
+			if expiry < 0 {
+				return nil, fmt.Errorf("invalid downlink expiry %d", expiry)
+			}
+			settings.Expiry = expiry
+		}
+		if batch, err := downlink.Get("batch").String(); err == nil {
+			if batch != BatchSequence && batch != BatchCombined {
+				return nil, fmt.Errorf("unknown downlink batch mode %q", batch)
+			}
+			settings.Batch = batch
+		}
+		if spacing, err := downlink.Get("spacing").Int(); err == nil {
+			if spacing < 0 {
+				return nil, fmt.Errorf("invalid downlink spacing %d", spacing)
+			}
+			settings.Spacing = spacing
+		}
+	}
+	return settings, nil
+}
+
+// encodeDownlink returns the downlink payload of an actuator. If the actuator has an
+// 'encoding' template, only its value is encoded. Else if the device has a codec, the
+// actuator values are encoded by the codec, named by their actuator IDs. Otherwise the
+// Wazigate Edge marshals the device.
+func encodeDownlink(entry RegistryEntry, device *waziup.Device, actuator *waziup.Actuator, fPort uint32) ([]byte, error) {
+	if actuator != nil && !actuator.Meta.Get("encoding").Undefined() {
+		data, err := encodeActuator(actuator, actuator.Value, fPort)
+		if err != nil {
+			return nil, fmt.Errorf("encoding of actuator %q: %v", actuator.ID, err)
+		}
+		return data, nil
+	}
+	c, err := deviceCodec(entry)
+	if err != nil {
+		return nil, err
+	}
+	if c == nil {
+		return wazigate.MarshalDevice(entry.ID)
+	}
+	data, err := c.Encode(fPort, actuatorValues(device))
+	if err != nil {
+		return nil, fmt.Errorf("can not encode actuator values: %v", err)
+	}
+	return data, nil
+}
+
+// actuatorValues returns the values of the device actuators by actuator ID.
+func actuatorValues(device *waziup.Device) map[string]interface{} {
+	values := make(map[string]interface{}, len(device.Actuators))
+	for _, actuator := range device.Actuators {
+		if actuator.Value != nil {
+			values[actuator.ID] = actuator.Value
+		}
+	}
+	return values
+}
+
+// EncodingJSON is the 'encoding' of actuators whose value is sent as JSON.
+const EncodingJSON = "json"
+
+// encodeActuator encodes a value of an actuator with the 'encoding' template of its
+// metadata: "json", a Cayenne LPP (or XLPP) 'channel' with an optional 'dataType', or
+// a codec like a byte 'layout' with a field named "value" or like the actuator.
+func encodeActuator(actuator *waziup.Actuator, value interface{}, fPort uint32) ([]byte, error) {
+	if value == nil {
+		return nil, errors.New("the actuator has no value")
+	}
+	spec := actuator.Meta.Get("encoding").Value()
+	if spec == EncodingJSON {
+		return json.Marshal(value)
+	}
+	typ, _ := actuator.Meta.Get("encoding").Get("type").String()
+	values := map[string]interface{}{"value": value, actuator.ID: value}
+	switch strings.ToLower(typ) {
+	case "cayenne", "cayennelpp", "lpp", "xlpp":
+		channel, err := actuator.Meta.Get("encoding").Get("channel").Int()
+		if err != nil || channel < 0 || channel > 255 {
+			return nil, errors.New("the Cayenne encoding needs a channel 0..255")
+		}
+		dataType, _ := actuator.Meta.Get("encoding").Get("dataType").String()
+		if dataType == "" {
+			dataType = "analogOutput"
+			if _, ok := value.(bool); ok {
+				dataType = "digitalOutput"
+			}
+		}
+		values = map[string]interface{}{fmt.Sprintf("%s_%d", dataType, channel): value}
+	}
+	c, err := codec.New(spec)
+	if err != nil {
+		return nil, err
+	}
+	return c.Encode(fPort, values)
+}
+
+// sendActuatorDownlink enqueues the downlink of an actuator like enqueueActuatorDownlink.
+// A downlink deferred by the duty cycle is enqueued once the budget is available,
+// unless a newer value of the actuator has been sent meanwhile.
+func sendActuatorDownlink(entry RegistryEntry, actuatorID string, settings *DownlinkSettings, data []byte) (string, error) {
+	key := entry.ID + "/" + actuatorID
+	seq := currentSequence(key)
+	id, err := enqueueActuatorDownlink(entry, actuatorID, settings, data)
+	if dcErr, ok := err.(*DutyCycleError); ok && dcErr.Deferred {
+		go func() {
+			time.Sleep(dcErr.Wait)
+			if !isSequence(key, seq) {
+				return
+			}
+			id, err := sendActuatorDownlink(entry, actuatorID, settings, data)
+			if err != nil {
+				log.Printf("Err Can not enqueue deferred payload of actuator %q: %v", actuatorID, err)
+				return
+			}
+			log.Printf("Deferred payload of actuator %q enqueued. Id %s", actuatorID, id)
+		}()
+	}
+	return id, err
+}
+
+// enqueueActuatorDownlink enqueues the downlink of an actuator following the queue policy
+// and returns the queue item ID. The delivery is tracked in the actuator metadata.
+// Downlinks that exceed the duty-cycle budget return a *DutyCycleError.
+func enqueueActuatorDownlink(entry RegistryEntry, actuatorID string, settings *DownlinkSettings, data []byte) (id string, err error) {
+	defer func() {
+		trackDelivery(entry.ID, actuatorID, id, settings.Confirmed, err)
+	}()
+
+	devEUI := fmt.Sprintf("%016X", entry.DevEUI)
+	key := entry.ID + "/" + actuatorID
+
+	reservation, err := reserveAirtime(deviceDownlinkChannel(entry), len(data), devEUI)
+	if err != nil {
+		if dcErr, ok := err.(*DutyCycleError); ok {
+			dcErr.Deferred = dutyCyclePolicy() == DutyCycleDefer
+		}
+		return "", err
+	}
+	defer func() {
+		if err != nil {
+			releaseDownlinkAirtime(reservation)
+		}
+	}()
+
+	unlock := lockDeviceQueue(devEUI)
+	defer unlock()
+
+	switch settings.Queue {
+	case QueueReplaceAll:
+		if err := flushQueue(entry); err != nil {
+			return "", err
+		}
+	case QueueDedupe:
+		// Without a queued downlink of the actuator, the queue is not flushed. A pending
+		// downlink is transmitted already, so it is not replaced.
+		lastID, queued := queuedActuatorDownlink(key)
+		if !queued {
+			break
+		}
+		removed, err := removeDownlinks(devEUI, func(item *asAPI.DeviceQueueItem) bool {
+			return item.Id == lastID
+		})
+		if err != nil {
+			return "", err
+		}
+		for _, id := range removed {
+			updateDelivery(id, DeliveryFailed, 0, "replaced by a newer downlink")
+		}
+		if len(removed) != 0 {
+			log.Printf("Removed the queued downlink of actuator %q.", actuatorID)
+		}
+	}
+
+	var expires time.Time
+	if settings.Expiry != 0 {
+		expires = time.Now().Add(time.Duration(settings.Expiry) * time.Second)
+	}
+	id, err = enqueueDownlink(&asAPI.DeviceQueueItem{
+		DevEui:    devEUI,
+		FPort:     settings.FPort,
+		Confirmed: settings.Confirmed,
+		Data:      data,
+	}, expires)
+	if err != nil {
+		return "", err
+	}
+	updateAirtime(reservation, id)
+	downlinks.Lock()
+	downlinks.actuators[key] = id
+	downlinks.Unlock()
+	return id, nil
+}
+
+// queuedActuatorDownlink returns the ID of the last downlink of an actuator, and if it
+// still waits in the device queue, not transmitted yet.
+func queuedActuatorDownlink(key string) (string, bool) {
+	downlinks.Lock()
+	defer downlinks.Unlock()
+	id := downlinks.actuators[key]
+	d := downlinks.deliveries[id]
+	return id, id != "" && d != nil && d.State == DeliveryQueued
+}
+
+// batchValue is a value of a batch, with the time it is sent at, if any.
+type batchValue struct {
+	value interface{}
+	time  time.Time
+}
+
+// parseActuatorValues reads a batch of actuator values, a list of values or of objects
+// with a "value" and an optional RFC 3339 "time".
+func parseActuatorValues(data []byte) ([]batchValue, error) {
+	var list []interface{}
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("invalid batch of values: %v", err)
+	}
+	values := make([]batchValue, len(list))
+	for i, item := range list {
+		values[i].value = item
+		obj, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if value, ok := obj["value"]; ok {
+			values[i].value = value
+		}
+		if t, ok := obj["time"]; ok {
+			s, _ := t.(string)
+			var err error
+			if values[i].time, err = time.Parse(time.RFC3339, s); err != nil {
+				return nil, fmt.Errorf("value %d: invalid time %v", i, t)
+			}
+		}
+	}
+	return values, nil
+}
+
+// batchEncoder returns the encoding of the values of a batch of an actuator: its
+// 'encoding' template, or else the device codec with the values of the other actuators.
+// The Wazigate Edge can only marshal the current values, so batches of other actuators
+// are refused.
+func batchEncoder(entry RegistryEntry, device *waziup.Device, actuator *waziup.Actuator, fPort uint32) (func(value interface{}) ([]byte, error), error) {
+	if !actuator.Meta.Get("encoding").Undefined() {
+		return func(value interface{}) ([]byte, error) {
+			return encodeActuator(actuator, value, fPort)
+		}, nil
+	}
+	c, err := deviceCodec(entry)
+	if err != nil {
+		return nil, err
+	}
+	if c == nil {
+		return nil, errors.New("a batch of values needs an 'encoding' of the actuator or a device codec")
+	}
+	return func(value interface{}) ([]byte, error) {
+		values := actuatorValues(device)
+		values[actuator.ID] = value
+		return c.Encode(fPort, values)
+	}, nil
+}
+
+// encodeActuatorValues encodes a batch of values as one payload: a JSON list, or the
+// payloads of the encoding of each value one after the other.
+func encodeActuatorValues(actuator *waziup.Actuator, values []batchValue, encode func(value interface{}) ([]byte, error)) ([]byte, error) {
+	if actuator.Meta.Get("encoding").Value() == EncodingJSON {
+		list := make([]interface{}, len(values))
+		for i, v := range values {
+			list[i] = v.value
+		}
+		return json.Marshal(list)
+	}
+	var data []byte
+	for i, v := range values {
+		b, err := encode(v.value)
+		if err != nil {
+			return nil, fmt.Errorf("value %d: %v", i, err)
+		}
+		data = append(data, b...)
+	}
+	return data, nil
+}
+
+// nextSequence cancels the pending batch of an actuator and returns the number of
+// the next one.
+func nextSequence(key string) int {
+	downlinks.Lock()
+	defer downlinks.Unlock()
+	downlinks.sequences[key]++
+	return downlinks.sequences[key]
+}
+
+// currentSequence returns the number of the current batch of an actuator.
+func currentSequence(key string) int {
+	downlinks.Lock()
+	defer downlinks.Unlock()
+	return downlinks.sequences[key]
+}
+
+// isSequence tells if a batch of an actuator has not been cancelled by a newer one.
+func isSequence(key string, n int) bool {
+	downlinks.Lock()
+	defer downlinks.Unlock()
+	return downlinks.sequences[key] == n
+}
+
+// sendActuatorBatch sends a batch of actuator values, following the batch mode of the
+// downlink settings. In a sequence, the first downlink follows the queue policy and the
+// others are appended. With a spacing or times, they are enqueued one after the other
+// in the background, until a newer value of the actuator cancels the sequence. A value
+// with a time is not enqueued before its time. Combined values can not have times.
+func sendActuatorBatch(entry RegistryEntry, device *waziup.Device, actuator *waziup.Actuator, settings *DownlinkSettings, values []batchValue) error {
+	key := entry.ID + "/" + actuator.ID
+	seq := nextSequence(key)
+	if len(values) == 0 {
+		return nil
+	}
+	encode, err := batchEncoder(entry, device, actuator, settings.FPort)
+	if err != nil {
+		return fmt.Errorf("actuator %q: %v", actuator.ID, err)
+	}
+	scheduled := false
+	for _, v := range values {
+		scheduled = scheduled || !v.time.IsZero()
+	}
+	if settings.Batch == BatchCombined {
+		if scheduled {
+			return fmt.Errorf("actuator %q: combined values can not have a time", actuator.ID)
+		}
+		data, err := encodeActuatorValues(actuator, values, encode)
+		if err != nil {
+			return fmt.Errorf("encoding of actuator %q: %v", actuator.ID, err)
+		}
+		id, err := sendActuatorDownlink(entry, actuator.ID, settings, data)
+		if err != nil {
+			return err
+		}
+		log.Printf("Payload with %d values enqueued. Id %s", len(values), id)
+		return nil
+	}
+
+	payloads := make([][]byte, len(values))
+	for i, v := range values {
+		data, err := encode(v.value)
+		if err != nil {
+			return fmt.Errorf("encoding of actuator %q: value %d: %v", actuator.ID, i, err)
+		}
+		payloads[i] = data
+	}
+	// send enqueues the payloads from the index 'from'. If the duty cycle defers a
+	// payload, the rest of the sequence is sent later, keeping the order.
+	var send func(from int) error
+	send = func(from int) error {
+		s := *settings
+		for i := from; i < len(payloads); i++ {
+			if i != 0 {
+				s.Queue = QueueAppend
+			}
+			if i != from {
+				time.Sleep(time.Duration(settings.Spacing) * time.Second)
+			}
+			if wait := time.Until(values[i].time); wait > 0 {
+				time.Sleep(wait)
+			}
+			if !isSequence(key, seq) {
+				log.Printf("Sequence of actuator %q cancelled after %d of %d values.", actuator.ID, i, len(payloads))
+				return nil
+			}
+			id, err := enqueueActuatorDownlink(entry, actuator.ID, &s, payloads[i])
+			if dcErr, ok := err.(*DutyCycleError); ok && dcErr.Deferred {
+				log.Printf("Payload %d of %d: %v", i+1, len(payloads), err)
+				go func() {
+					time.Sleep(dcErr.Wait)
+					if err := send(i); err != nil {
+						log.Printf("Err Can not enqueue payload: %v", err)
+					}
+				}()
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			log.Printf("Payload %d of %d enqueued. Id %s", i+1, len(payloads), id)
+		}
+		return nil
+	}
+	if settings.Spacing == 0 && !scheduled {
+		return send(0)
+	}
+	go func() {
+		if err := send(0); err != nil {
+			log.Printf("Err Can not enqueue payload: %v", err)
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,91 @@
+package app
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Waziup/wazigate-lora/internal/pkg/waziup"
+)
+
+func TestParseActuatorValues(t *testing.T) {
+	at := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		data   string
+		values []batchValue
+		err    bool
+	}{
+		{"values", `[1, true, "on"]`, []batchValue{{value: 1.0}, {value: true}, {value: "on"}}, false},
+		{"objects", `[{"value": 20}, {"value": 21, "time": "2026-10-18T12:00:00Z"}]`, []batchValue{{value: 20.0}, {value: 21.0, time: at}}, false},
+		{"object without value", `[{"r": 1}]`, []batchValue{{value: map[string]interface{}{"r": 1.0}}}, false},
+		{"empty", `[]`, []batchValue{}, false},
+		{"not a list", `{"value": 1}`, nil, true},
+		{"invalid time", `[{"value": 1, "time": "noon"}]`, nil, true},
+	}
+	for _, test := range tests {
+		values, err := parseActuatorValues([]byte(test.data))
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: no error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(values, test.values) {
+			t.Errorf("%s: got %v, want %v", test.name, values, test.values)
+		}
+	}
+}
+
+func TestEncodeActuatorValues(t *testing.T) {
+	values := []batchValue{{value: 1.0}, {value: 0.0}}
+	tests := []struct {
+		name     string
+		encoding interface{}
+		data     []byte
+	}{
+		{"json", "json", []byte(`[1,0]`)},
+		{"cayenne", map[string]interface{}{"type": "cayenne", "channel": 2.0, "dataType": "digitalOutput"}, []byte{0x02, 0x01, 0x01, 0x02, 0x01, 0x00}},
+		{"layout", map[string]interface{}{"type": "layout", "fields": []interface{}{map[string]interface{}{"name": "value", "type": "uint16"}}}, []byte{0x00, 0x01, 0x00, 0x00}},
+	}
+	for _, test := range tests {
+		actuator := &waziup.Actuator{ID: "valve", Meta: waziup.Meta{"encoding": test.encoding}}
+		data, err := encodeActuatorValues(actuator, values, func(value interface{}) ([]byte, error) {
+			return encodeActuator(actuator, value, 1)
+		})
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !bytes.Equal(data, test.data) {
+			t.Errorf("%s: got % X, want % X", test.name, data, test.data)
+		}
+	}
+
+	actuator := &waziup.Actuator{ID: "valve", Meta: waziup.Meta{"encoding": map[string]interface{}{"type": "cayenne"}}}
+	if _, err := encodeActuatorValues(actuator, values, func(value interface{}) ([]byte, error) {
+		return encodeActuator(actuator, value, 1)
+	}); err == nil {
+		t.Errorf("cayenne without channel: no error")
+	}
+}
+
+func TestSequences(t *testing.T) {
+	key := "test-device/valve"
+	first := nextSequence(key)
+	if !isSequence(key, first) || currentSequence(key) != first {
+		t.Fatalf("sequence %d is not current", first)
+	}
+	second := nextSequence(key)
+	if second != first+1 {
+		t.Errorf("next sequence is %d, want %d", second, first+1)
+	}
+	if isSequence(key, first) {
+		t.Errorf("sequence %d has not been cancelled by %d", first, second)
+	}
+}
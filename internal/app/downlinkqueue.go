@@ -0,0 +1,401 @@
+package app
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	asAPI "github.com/chirpstack/chirpstack/api/go/v4/api"
+)
+
+const downlinkExpiryInterval = 10 * time.Second
+
+// DownlinkRequest is a raw downlink to enqueue, with the payload either as hex or as base64.
+type DownlinkRequest struct {
+	Hex       string `json:"hex,omitempty"`
+	Base64    string `json:"base64,omitempty"`
+	FPort     uint32 `json:"fPort"`
+	Confirmed bool   `json:"confirmed"`
+	// Expiry in seconds. Downlinks that have not been sent until then are removed.
+	Expiry int `json:"expiry,omitempty"`
+}
+
+// QueueItem is a downlink in the ChirpStack device queue.
+type QueueItem struct {
+	ID        string     `json:"id"`
+	FPort     uint32     `json:"fPort"`
+	Confirmed bool       `json:"confirmed"`
+	Hex       string     `json:"hex"`
+	IsPending bool       `json:"isPending"`
+	FCntDown  uint32     `json:"fCntDown,omitempty"`
+	Expires   *time.Time `json:"expires,omitempty"`
+}
+
+// DeviceQueue is the ChirpStack device queue of a Wazigate device.
+type DeviceQueue struct {
+	ID     string      `json:"id"`
+	DevEUI string      `json:"devEUI"`
+	Items  []QueueItem `json:"items"`
+}
+
+// downlinks tracks the downlinks enqueued by this service: their expiry by queue
+// item ID, as the ChirpStack queue has no expiry, the last downlink of each actuator,
+// the delivery of actuator downlinks by queue item ID and the batch sequence of each
+// actuator. They are not persisted, so downlinks queued before a restart never expire.
+var downlinks = struct {
+	sync.Mutex
+	expiries   map[string]downlinkExpiry
+	actuators  map[string]string
+	deliveries map[string]*Delivery
+	sequences  map[string]int
+}{
+	expiries:   make(map[string]downlinkExpiry),
+	actuators:  make(map[string]string),
+	deliveries: make(map[string]*Delivery),
+	sequences:  make(map[string]int),
+}
+
+type downlinkExpiry struct {
+	devEUI  string
+	expires time.Time
+}
+
+// deviceQueues serializes the changes of each ChirpStack device queue, as removing
+// downlinks flushes the queue and enqueues the other downlinks again.
+var deviceQueues = struct {
+	sync.Mutex
+	locks map[string]*sync.Mutex
+}{locks: make(map[string]*sync.Mutex)}
+
+// lockDeviceQueue locks the device queue of a DevEUI and returns the unlock function.
+func lockDeviceQueue(devEUI string) func() {
+	deviceQueues.Lock()
+	mutex := deviceQueues.locks[devEUI]
+	if mutex == nil {
+		mutex = new(sync.Mutex)
+		deviceQueues.locks[devEUI] = mutex
+	}
+	deviceQueues.Unlock()
+	mutex.Lock()
+	return mutex.Unlock
+}
+
+// renameDownlink must be called with downlinks locked, when a downlink has been
+// enqueued again with a new ID.
+func renameDownlink(oldID string, newID string) {
+	if expiry, ok := downlinks.expiries[oldID]; ok {
+		delete(downlinks.expiries, oldID)
+		downlinks.expiries[newID] = expiry
+	}
+	for key, id := range downlinks.actuators {
+		if id == oldID {
+			downlinks.actuators[key] = newID
+		}
+	}
+	if delivery, ok := downlinks.deliveries[oldID]; ok {
+		delete(downlinks.deliveries, oldID)
+		delivery.ID = newID
+		downlinks.deliveries[newID] = delivery
+	}
+	updateAirtime(oldID, newID)
+}
+
+// queueDevice returns the registry entry of a Wazigate device ID or a DevEUI.
+func queueDevice(id string) (RegistryEntry, error) {
+	if entry, ok := registry.ByID(id); ok {
+		return entry, nil
+	}
+	if devEUI, err := strconv.ParseUint(id, 16, 64); err == nil && len(id) == 16 {
+		if entry, ok := registry.ByDevEUI(devEUI); ok {
+			return entry, nil
+		}
+	}
+	return RegistryEntry{}, fmt.Errorf("no LoRaWAN device %q", id)
+}
+
+// getDeviceQueue lists the downlinks in the ChirpStack device queue.
+func getDeviceQueue(entry RegistryEntry) (*DeviceQueue, error) {
+	devEUI := fmt.Sprintf("%016X", entry.DevEUI)
+
+	conn, err := connectToChirpStack()
+	if err != nil {
+		return nil, fmt.Errorf("grpc: can not connect to ChirpStack: %v", err)
+	}
+	defer conn.Close()
+
+	deviceService := asAPI.NewDeviceServiceClient(conn)
+	resp, err := deviceService.GetQueue(context.Background(), &asAPI.GetDeviceQueueItemsRequest{
+		DevEui: devEUI,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("grpc: can not get device queue: %v", err)
+	}
+
+	downlinks.Lock()
+	defer downlinks.Unlock()
+
+	queue := &DeviceQueue{
+		ID:     entry.ID,
+		DevEUI: devEUI,
+		Items:  make([]QueueItem, len(resp.Result)),
+	}
+	for i, item := range resp.Result {
+		queue.Items[i] = QueueItem{
+			ID:        item.Id,
+			FPort:     item.FPort,
+			Confirmed: item.Confirmed,
+			Hex:       fmt.Sprintf("%X", item.Data),
+			IsPending: item.IsPending,
+			FCntDown:  item.FCntDown,
+		}
+		if expiry, ok := downlinks.expiries[item.Id]; ok {
+			expires := expiry.expires
+			queue.Items[i].Expires = &expires
+		}
+	}
+	return queue, nil
+}
+
+// flushDeviceQueue removes all downlinks from the ChirpStack device queue.
+func flushDeviceQueue(entry RegistryEntry) error {
+	devEUI := fmt.Sprintf("%016X", entry.DevEUI)
+	unlock := lockDeviceQueue(devEUI)
+	defer unlock()
+	return flushQueue(entry)
+}
+
+// flushQueue must be called with the device queue locked. It removes all downlinks
+// from the ChirpStack device queue.
+func flushQueue(entry RegistryEntry) error {
+	conn, err := connectToChirpStack()
+	if err != nil {
+		return fmt.Errorf("grpc: can not connect to ChirpStack: %v", err)
+	}
+	defer conn.Close()
+
+	deviceService := asAPI.NewDeviceServiceClient(conn)
+	_, err = deviceService.FlushQueue(context.Background(), &asAPI.FlushDeviceQueueRequest{
+		DevEui: fmt.Sprintf("%016X", entry.DevEUI),
+	})
+	if err != nil {
+		return fmt.Errorf("grpc: can not flush device queue: %v", err)
+	}
+	releaseDeviceAirtime(fmt.Sprintf("%016X", entry.DevEUI))
+	failDeliveries(entry.ID, "flushed from the device queue")
+	return nil
+}
+
+// payload returns the decoded hex or base64 payload of the request.
+func (req *DownlinkRequest) payload() ([]byte, error) {
+	switch {
+	case req.Hex != "" && req.Base64 != "":
+		return nil, errors.New("either 'hex' or 'base64' must be set, not both")
+	case req.Hex != "":
+		data, err := hex.DecodeString(req.Hex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid hex: %v", err)
+		}
+		return data, nil
+	case req.Base64 != "":
+		data, err := base64.StdEncoding.DecodeString(req.Base64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid base64: %v", err)
+		}
+		return data, nil
+	default:
+		return []byte{}, nil
+	}
+}
+
+// enqueueRawDownlink adds a raw downlink to the ChirpStack device queue and returns its ID.
+func enqueueRawDownlink(entry RegistryEntry, req *DownlinkRequest) (string, error) {
+	data, err := req.payload()
+	if err != nil {
+		return "", err
+	}
+	if req.FPort < 1 || req.FPort > 223 {
+		return "", fmt.Errorf("invalid fPort %d, must be 1..223", req.FPort)
+	}
+	devEUI := fmt.Sprintf("%016X", entry.DevEUI)
+	reservation, err := reserveAirtime(deviceDownlinkChannel(entry), len(data), devEUI)
+	if err != nil {
+		return "", err
+	}
+	var expires time.Time
+	if req.Expiry > 0 {
+		expires = time.Now().Add(time.Duration(req.Expiry) * time.Second)
+	}
+	unlock := lockDeviceQueue(devEUI)
+	defer unlock()
+	id, err := enqueueDownlink(&asAPI.DeviceQueueItem{
+		DevEui:    devEUI,
+		FPort:     req.FPort,
+		Confirmed: req.Confirmed,
+		Data:      data,
+	}, expires)
+	if err != nil {
+		releaseDownlinkAirtime(reservation)
+		return "", err
+	}
+	updateAirtime(reservation, id)
+	return id, nil
+}
+
+// enqueueDownlink must be called with the device queue locked. It adds a downlink to the
+// ChirpStack device queue and returns its ID. A downlink with an expiry is removed from
+// the queue if it has not been sent until then.
+func enqueueDownlink(item *asAPI.DeviceQueueItem, expires time.Time) (string, error) {
+	conn, err := connectToChirpStack()
+	if err != nil {
+		return "", fmt.Errorf("grpc: can not connect to ChirpStack: %v", err)
+	}
+	defer conn.Close()
+
+	deviceService := asAPI.NewDeviceServiceClient(conn)
+	resp, err := deviceService.Enqueue(context.Background(), &asAPI.EnqueueDeviceQueueItemRequest{
+		QueueItem: item,
+	})
+	if err != nil {
+		return "", fmt.Errorf("grpc: can not enqueue downlink: %v", err)
+	}
+	if !expires.IsZero() {
+		downlinks.Lock()
+		downlinks.expiries[resp.Id] = downlinkExpiry{item.DevEui, expires}
+		downlinks.Unlock()
+	}
+	return resp.Id, nil
+}
+
+// RunDownlinkExpiry removes expired downlinks from the ChirpStack device queues.
+func RunDownlinkExpiry() {
+	for {
+		time.Sleep(downlinkExpiryInterval)
+
+		now := time.Now()
+		devEUIs := make(map[string]struct{})
+		downlinks.Lock()
+		for _, expiry := range downlinks.expiries {
+			if now.After(expiry.expires) {
+				devEUIs[expiry.devEUI] = struct{}{}
+			}
+		}
+		downlinks.Unlock()
+
+		for devEUI := range devEUIs {
+			unlock := lockDeviceQueue(devEUI)
+			removed, err := removeDownlinks(devEUI, func(item *asAPI.DeviceQueueItem) bool {
+				expiry, ok := downlinks.expiries[item.Id]
+				return ok && now.After(expiry.expires)
+			})
+			unlock()
+			if err != nil {
+				log.Printf("Err Can not remove expired downlinks of %s: %v", devEUI, err)
+			}
+			if len(removed) != 0 {
+				log.Printf("Removed %d expired downlinks of %s.", len(removed), devEUI)
+			}
+			for _, id := range removed {
+				updateDelivery(id, DeliveryExpired, 0, "")
+			}
+		}
+	}
+}
+
+// removeDownlinks must be called with the device queue locked. It removes the downlinks
+// of a device queue that match, and returns their IDs. The match function is called with
+// downlinks locked. As ChirpStack can only flush the whole queue, the other downlinks are
+// enqueued again, with new IDs. Downlinks that can not be enqueued again are lost and
+// their deliveries fail. While a downlink is pending (sent but not yet acknowledged),
+// nothing is removed. The ChirpStack calls are made with downlinks unlocked, so they do
+// not hold up the delivery tracking of other devices.
+func removeDownlinks(devEUI string, match func(item *asAPI.DeviceQueueItem) bool) ([]string, error) {
+	ctx := context.Background()
+
+	conn, err := connectToChirpStack()
+	if err != nil {
+		return nil, fmt.Errorf("grpc: can not connect to ChirpStack: %v", err)
+	}
+	defer conn.Close()
+
+	deviceService := asAPI.NewDeviceServiceClient(conn)
+	resp, err := deviceService.GetQueue(ctx, &asAPI.GetDeviceQueueItemsRequest{
+		DevEui: devEUI,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("grpc: can not get device queue: %v", err)
+	}
+
+	downlinks.Lock()
+	queued := make(map[string]struct{}, len(resp.Result))
+	var keep []*asAPI.DeviceQueueItem
+	var removed []string
+	pending := false
+	for _, item := range resp.Result {
+		queued[item.Id] = struct{}{}
+		pending = pending || item.IsPending
+		if !item.IsPending && match(item) {
+			removed = append(removed, item.Id)
+			continue
+		}
+		keep = append(keep, item)
+	}
+	// forget the downlinks that have been sent meanwhile
+	for id, expiry := range downlinks.expiries {
+		if _, ok := queued[id]; !ok && expiry.devEUI == devEUI {
+			delete(downlinks.expiries, id)
+		}
+	}
+	downlinks.Unlock()
+	if len(removed) == 0 || pending {
+		// A pending downlink would be lost by the flush, so try again later.
+		return nil, nil
+	}
+
+	if _, err := deviceService.FlushQueue(ctx, &asAPI.FlushDeviceQueueRequest{
+		DevEui: devEUI,
+	}); err != nil {
+		return nil, fmt.Errorf("grpc: can not flush device queue: %v", err)
+	}
+	forgetDownlinks(removed)
+	for i, item := range keep {
+		oldID := item.Id
+		item.Id = ""
+		if !item.IsEncrypted {
+			item.FCntDown = 0
+		}
+		r, err := deviceService.Enqueue(ctx, &asAPI.EnqueueDeviceQueueItemRequest{
+			QueueItem: item,
+		})
+		if err != nil {
+			lost := []string{oldID}
+			for _, item := range keep[i+1:] {
+				lost = append(lost, item.Id)
+			}
+			forgetDownlinks(lost)
+			for _, id := range lost {
+				updateDelivery(id, DeliveryFailed, 0, "lost while removing other downlinks from the device queue")
+			}
+			return removed, fmt.Errorf("grpc: can not enqueue %d downlinks again: %v", len(lost), err)
+		}
+		downlinks.Lock()
+		renameDownlink(oldID, r.Id)
+		downlinks.Unlock()
+	}
+	return removed, nil
+}
+
+// forgetDownlinks drops the expiries and airtime of downlinks removed from the queue.
+func forgetDownlinks(ids []string) {
+	downlinks.Lock()
+	for _, id := range ids {
+		delete(downlinks.expiries, id)
+	}
+	downlinks.Unlock()
+	releaseDownlinkAirtime(ids...)
+}
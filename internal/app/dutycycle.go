@@ -0,0 +1,338 @@
+package app
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	asAPI "github.com/chirpstack/chirpstack/api/go/v4/api"
+	"github.com/chirpstack/chirpstack/api/go/v4/common"
+	asIntegr "github.com/chirpstack/chirpstack/api/go/v4/integration"
+)
+
+// Duty-cycle policies of the 'duty_cycle' config.
+const (
+	// DutyCycleDefer enqueues downlinks that exceed the budget once it is available (default).
+	DutyCycleDefer = "defer"
+	// DutyCycleRefuse drops downlinks that exceed the budget.
+	DutyCycleRefuse = "refuse"
+	// DutyCycleOff disables the duty-cycle budget.
+	DutyCycleOff = "off"
+)
+
+// dutyCycleWindow is the period over which the duty cycle of a band is measured.
+const dutyCycleWindow = time.Hour
+
+const (
+	// rx2Frequency and rx2SpreadingFactor are the EU868 RX2 defaults, also used by
+	// Class B ping slots, Class C downlinks and multicast groups without a frequency.
+	rx2Frequency       = 869525000
+	rx2SpreadingFactor = 12
+	// phyOverhead is the size of the LoRaWAN frame without FOpts around the FRMPayload:
+	// MHDR, FHDR, FPort and MIC.
+	phyOverhead = 13
+)
+
+// SubBand is a frequency band with a duty-cycle limit.
+type SubBand struct {
+	Name      string  `json:"name"`
+	MinFreq   uint32  `json:"minFrequency"`
+	MaxFreq   uint32  `json:"maxFrequency"`
+	DutyCycle float64 `json:"dutyCycle"`
+}
+
+// dutyCycleBands are the sub-bands of the regions with duty-cycle limits
+// (ETSI EN 300 220 for EU868). Other regions have no budget.
+var dutyCycleBands = map[common.Region][]SubBand{
+	common.Region_EU868: {
+		{"K", 863000000, 865000000, 0.001},
+		{"L", 865000000, 868000000, 0.01},
+		{"M", 868000000, 868600000, 0.01},
+		{"N", 868700000, 869200000, 0.001},
+		{"P", 869400000, 869650000, 0.1},
+		{"Q", 869700000, 870000000, 0.01},
+	},
+}
+
+// airtime returns the time on air of a LoRa frame of size bytes, with the LoRaWAN
+// downlink settings: 125 kHz, coding rate 4/5, 8 preamble symbols, explicit header
+// and no CRC (Semtech AN1200.13).
+func airtime(sf int, size int) time.Duration {
+	const bandwidth = 125000.0
+	tSym := math.Exp2(float64(sf)) / bandwidth
+	de := 0
+	if sf >= 11 {
+		de = 1
+	}
+	n := math.Ceil(float64(8*size-4*sf+28) / float64(4*(sf-2*de)))
+	symbols := 8 + math.Max(n*5, 0)
+	seconds := (8+4.25)*tSym + symbols*tSym
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// downlinkChannel is the frequency and spreading factor downlinks to a device are
+// expected to use.
+type downlinkChannel struct {
+	Frequency       uint32
+	SpreadingFactor int
+}
+
+// airtimeRecord is the airtime of a downlink. The id is a reservation key while the
+// downlink is enqueued, then its queue item ID until it is transmitted, so that the
+// airtime of downlinks that fail to be enqueued or are removed from the queue is
+// released. The queue is the DevEUI, or the multicast queue key.
+type airtimeRecord struct {
+	time    time.Time
+	airtime time.Duration
+	id      string
+	queue   string
+}
+
+// reservationPrefix starts the keys of reservations of downlinks being enqueued.
+const reservationPrefix = "reservation/"
+
+// dutyCycle holds the airtime of recent downlinks per sub-band, and the channel of
+// the last uplink of each device, as Class A downlinks are sent in RX1 on the uplink
+// channel and data rate.
+var dutyCycle = struct {
+	sync.Mutex
+	used         map[string][]airtimeRecord
+	channels     map[uint64]downlinkChannel
+	reservations int
+}{
+	used:     make(map[string][]airtimeRecord),
+	channels: make(map[uint64]downlinkChannel),
+}
+
+// DutyCycleError is returned for downlinks that exceed the duty-cycle budget.
+type DutyCycleError struct {
+	Band     string
+	Wait     time.Duration
+	Deferred bool
+}
+
+func (err *DutyCycleError) Error() string {
+	if err.Deferred {
+		return fmt.Sprintf("duty cycle of band %s exceeded, deferred for %v", err.Band, err.Wait)
+	}
+	return fmt.Sprintf("duty cycle of band %s exceeded, budget available in %v", err.Band, err.Wait)
+}
+
+func dutyCyclePolicy() string {
+	if Config.DutyCycle.Policy == "" {
+		return DutyCycleDefer
+	}
+	return Config.DutyCycle.Policy
+}
+
+func dutyCycleRegion() common.Region {
+	if len(Config.DeviceProfiles) != 0 {
+		return Config.DeviceProfiles[0].Region
+	}
+	return common.Region_EU868
+}
+
+// subBand returns the duty-cycle band of a frequency, or nil.
+func subBand(freq uint32) *SubBand {
+	bands := dutyCycleBands[dutyCycleRegion()]
+	for i := range bands {
+		if freq >= bands[i].MinFreq && freq < bands[i].MaxFreq {
+			return &bands[i]
+		}
+	}
+	return nil
+}
+
+// setUplinkChannel remembers the channel of the last uplink of a device.
+func setUplinkChannel(entry RegistryEntry, uplinkEvt *asIntegr.UplinkEvent) {
+	link := newLinkQuality(uplinkEvt)
+	if link == nil || link.Frequency == 0 || link.SpreadingFactor == 0 {
+		return
+	}
+	dutyCycle.Lock()
+	dutyCycle.channels[entry.DevEUI] = downlinkChannel{link.Frequency, int(link.SpreadingFactor)}
+	dutyCycle.Unlock()
+}
+
+// deviceDownlinkChannel returns the expected downlink channel of a device: RX1 on the
+// last uplink channel for Class A devices, otherwise RX2.
+func deviceDownlinkChannel(entry RegistryEntry) downlinkChannel {
+	if class, err := deviceClass(entry.Meta()); err == nil && class.Class == ClassA {
+		dutyCycle.Lock()
+		channel, ok := dutyCycle.channels[entry.DevEUI]
+		dutyCycle.Unlock()
+		if ok {
+			return channel
+		}
+	}
+	return downlinkChannel{rx2Frequency, rx2SpreadingFactor}
+}
+
+// reserveAirtime adds the airtime of a downlink of size bytes to the budget of its band
+// and returns the reservation key, before the downlink is enqueued. Once enqueued, the
+// key is replaced with the queue item ID by updateAirtime, otherwise the reservation is
+// released. If the budget would be exceeded, nothing is reserved and a *DutyCycleError
+// tells when it is available again.
+func reserveAirtime(channel downlinkChannel, size int, queue string) (string, error) {
+	band := subBand(channel.Frequency)
+	if band == nil || dutyCyclePolicy() == DutyCycleOff {
+		return "", nil
+	}
+	t := airtime(channel.SpreadingFactor, phyOverhead+size)
+	budget := time.Duration(band.DutyCycle * float64(dutyCycleWindow))
+	now := time.Now()
+
+	dutyCycle.Lock()
+	defer dutyCycle.Unlock()
+
+	records := usedAirtime(band.Name, now)
+	var used time.Duration
+	for _, r := range records {
+		used += r.airtime
+	}
+	if used+t > budget {
+		// wait until enough of the oldest downlinks leave the window
+		wait := dutyCycleWindow
+		for _, r := range records {
+			used -= r.airtime
+			if used+t <= budget {
+				wait = r.time.Add(dutyCycleWindow).Sub(now)
+				break
+			}
+		}
+		return "", &DutyCycleError{Band: band.Name, Wait: wait.Round(time.Second) + time.Second}
+	}
+	dutyCycle.reservations++
+	key := fmt.Sprintf("%s%d", reservationPrefix, dutyCycle.reservations)
+	dutyCycle.used[band.Name] = append(records, airtimeRecord{now, t, key, queue})
+	return key, nil
+}
+
+// releaseAirtime removes the airtime of the downlinks that match and have not been
+// transmitted yet, as they have been removed from the queue.
+func releaseAirtime(match func(r airtimeRecord) bool) {
+	dutyCycle.Lock()
+	defer dutyCycle.Unlock()
+
+	for band, records := range dutyCycle.used {
+		kept := records[:0]
+		for _, r := range records {
+			if r.id == "" || !match(r) {
+				kept = append(kept, r)
+			}
+		}
+		dutyCycle.used[band] = kept
+	}
+}
+
+// releaseDownlinkAirtime removes the airtime of downlinks removed from the queue.
+func releaseDownlinkAirtime(ids ...string) {
+	releaseAirtime(func(r airtimeRecord) bool {
+		for _, id := range ids {
+			if r.id == id {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// releaseDeviceAirtime removes the airtime of the downlinks of a flushed device queue.
+// Downlinks that are being enqueued are not in the queue yet, so they are kept.
+func releaseDeviceAirtime(devEUI string) {
+	releaseAirtime(func(r airtimeRecord) bool {
+		return r.queue == devEUI && !strings.HasPrefix(r.id, reservationPrefix)
+	})
+}
+
+// updateAirtime changes the reservation key or queue item ID of the airtime of a
+// downlink, when it has been enqueued (again), or clears it when it has been transmitted.
+func updateAirtime(oldID string, newID string) {
+	if oldID == "" {
+		return
+	}
+	dutyCycle.Lock()
+	defer dutyCycle.Unlock()
+
+	for _, records := range dutyCycle.used {
+		for i := range records {
+			if records[i].id == oldID {
+				records[i].id = newID
+				return
+			}
+		}
+	}
+}
+
+// usedAirtime must be called with dutyCycle locked. It drops the records that left
+// the window and returns the others, oldest first.
+func usedAirtime(band string, now time.Time) []airtimeRecord {
+	records := dutyCycle.used[band]
+	i := 0
+	for i < len(records) && now.Sub(records[i].time) >= dutyCycleWindow {
+		i++
+	}
+	records = records[i:]
+	dutyCycle.used[band] = records
+	return records
+}
+
+// multicastChannel returns the downlink channel of a multicast group.
+func multicastChannel(mg *asAPI.MulticastGroup) downlinkChannel {
+	sf := rx2SpreadingFactor - int(mg.Dr)
+	if sf < 7 {
+		sf = 7
+	}
+	return downlinkChannel{mg.Frequency, sf}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// DutyCycleStatus is the duty-cycle budget of the region.
+type DutyCycleStatus struct {
+	Region string            `json:"region"`
+	Policy string            `json:"policy"`
+	Window float64           `json:"window"`
+	Bands  []DutyCycleBudget `json:"bands"`
+}
+
+// DutyCycleBudget is the budget of a sub-band, in seconds of airtime in the window.
+type DutyCycleBudget struct {
+	SubBand
+	Budget    float64 `json:"budget"`
+	Used      float64 `json:"used"`
+	Available float64 `json:"available"`
+	Downlinks int     `json:"downlinks"`
+}
+
+// GetDutyCycleStatus returns the current duty-cycle budget of each band.
+func GetDutyCycleStatus() *DutyCycleStatus {
+	region := dutyCycleRegion()
+	status := &DutyCycleStatus{
+		Region: region.String(),
+		Policy: dutyCyclePolicy(),
+		Window: dutyCycleWindow.Seconds(),
+		Bands:  []DutyCycleBudget{},
+	}
+	now := time.Now()
+
+	dutyCycle.Lock()
+	defer dutyCycle.Unlock()
+
+	for _, band := range dutyCycleBands[region] {
+		budget := DutyCycleBudget{
+			SubBand: band,
+			Budget:  band.DutyCycle * dutyCycleWindow.Seconds(),
+		}
+		records := usedAirtime(band.Name, now)
+		for _, r := range records {
+			budget.Used += r.airtime.Seconds()
+		}
+		budget.Downlinks = len(records)
+		budget.Available = math.Max(budget.Budget-budget.Used, 0)
+		status.Bands = append(status.Bands, budget)
+	}
+	return status
+}
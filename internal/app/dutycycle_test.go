@@ -0,0 +1,117 @@
+package app
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestAirtime(t *testing.T) {
+	// Semtech AN1200.13 with 125 kHz, CR 4/5, 8 preamble symbols, explicit header
+	// and no CRC, as LoRaWAN downlinks are sent. The empty SF12 frame matches the
+	// well-known 1155.1 ms of an uplink, as its CRC fits in the last symbols.
+	tests := []struct {
+		sf   int
+		size int
+		ms   float64
+	}{
+		{7, 1, 25.856},
+		{7, 13, 41.216},
+		{7, 25, 61.696},
+		{7, 64, 118.016},
+		{8, 1, 51.712},
+		{9, 13, 144.384},
+		{10, 20, 329.728},
+		{11, 13, 577.536},
+		{12, 13, 1155.072},
+		{12, 64, 2793.472},
+	}
+	for _, test := range tests {
+		got := airtime(test.sf, test.size)
+		want := time.Duration(test.ms * float64(time.Millisecond))
+		if diff := got - want; diff < -time.Microsecond || diff > time.Microsecond {
+			t.Errorf("airtime(SF%d, %d bytes) = %v, want %v", test.sf, test.size, got, want)
+		}
+	}
+}
+
+func resetDutyCycle() {
+	dutyCycle.Lock()
+	dutyCycle.used = make(map[string][]airtimeRecord)
+	dutyCycle.Unlock()
+}
+
+func TestReserveAirtime(t *testing.T) {
+	resetDutyCycle()
+	defer resetDutyCycle()
+
+	// band N has 0.1 % of an hour, 3.6 s: three empty SF12 frames of 1155 ms fit
+	channel := downlinkChannel{868800000, 12}
+	var keys []string
+	for i := 0; i < 3; i++ {
+		key, err := reserveAirtime(channel, 0, "0000000000000001")
+		if err != nil {
+			t.Fatalf("reservation %d: %v", i+1, err)
+		}
+		if key == "" {
+			t.Fatalf("reservation %d has no key", i+1)
+		}
+		keys = append(keys, key)
+	}
+
+	_, err := reserveAirtime(channel, 0, "0000000000000001")
+	var dutyCycleErr *DutyCycleError
+	if !errors.As(err, &dutyCycleErr) {
+		t.Fatalf("reservation 4: got %v, want a DutyCycleError", err)
+	}
+	if dutyCycleErr.Band != "N" || dutyCycleErr.Wait < 59*time.Minute || dutyCycleErr.Wait > dutyCycleWindow+time.Second {
+		t.Errorf("reservation 4: got band %s and wait %v", dutyCycleErr.Band, dutyCycleErr.Wait)
+	}
+
+	// other bands have their own budget
+	if _, err := reserveAirtime(downlinkChannel{869525000, 12}, 0, "0000000000000001"); err != nil {
+		t.Errorf("band P: %v", err)
+	}
+	// frequencies outside of the bands have no budget
+	if key, err := reserveAirtime(downlinkChannel{915000000, 12}, 0, "0000000000000001"); key != "" || err != nil {
+		t.Errorf("915 MHz: got %q, %v", key, err)
+	}
+
+	// a failed enqueue releases its reservation
+	releaseDownlinkAirtime(keys[0])
+	key, err := reserveAirtime(channel, 0, "0000000000000001")
+	if err != nil {
+		t.Fatalf("after release: %v", err)
+	}
+
+	// flushing the queue keeps reservations, but releases enqueued downlinks
+	updateAirtime(keys[1], "queue-item-1")
+	releaseDeviceAirtime("0000000000000001")
+	if _, err := reserveAirtime(channel, 0, "0000000000000002"); err != nil {
+		t.Fatalf("after flush: %v", err)
+	}
+	if _, err := reserveAirtime(channel, 0, "0000000000000002"); err == nil {
+		t.Errorf("after flush: the reservations %s and %s have been released", keys[2], key)
+	}
+
+	// transmitted downlinks keep their airtime
+	updateAirtime(keys[2], "")
+	releaseDeviceAirtime("0000000000000001")
+	releaseAirtime(func(r airtimeRecord) bool { return true })
+	if status := GetDutyCycleStatus(); status.Bands[3].Downlinks != 1 {
+		t.Errorf("band N has %d downlinks, want the transmitted one", status.Bands[3].Downlinks)
+	}
+}
+
+func TestReserveAirtimeOff(t *testing.T) {
+	resetDutyCycle()
+	defer resetDutyCycle()
+	Config.DutyCycle.Policy = DutyCycleOff
+	defer func() { Config.DutyCycle.Policy = "" }()
+
+	for i := 0; i < 10; i++ {
+		if key, err := reserveAirtime(downlinkChannel{868800000, 12}, 51, "0000000000000001"); key != "" || err != nil {
+			t.Fatalf("reservation %d: got %q, %v", i+1, key, err)
+		}
+	}
+}
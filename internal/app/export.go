@@ -0,0 +1,170 @@
+package app
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+
+	"github.com/Waziup/wazigate-lora/internal/pkg/wazigate"
+	"github.com/Waziup/wazigate-lora/internal/pkg/waziup"
+	asAPI "github.com/chirpstack/chirpstack/api/go/v4/api"
+	"github.com/chirpstack/chirpstack/api/go/v4/common"
+)
+
+// redacted replaces keys in redacted exports.
+const redacted = "********"
+
+// ExportRow is one device of the inventory export. It has the same fields as an
+// ImportRow, so an export can be imported on another gateway.
+type ExportRow struct {
+	ID string `json:"id"`
+	ImportRow
+	Error string `json:"error,omitempty"`
+}
+
+var exportCSVHeader = []string{
+	"id", "name", "devEUI", "profile", "joinEUI", "appKey", "nwkKey",
+	"devAddr", "appSKey", "nwkSEncKey", "sNwkSIntKey", "fNwkSIntKey",
+	"fCntUp", "fCntDown", "error",
+}
+
+func (row *ExportRow) csv() []string {
+	return []string{
+		row.ID, row.Name, row.DevEUI, row.Profile, row.JoinEUI, row.AppKey, row.NwkKey,
+		row.DevAddr, row.AppSKey, row.NwkSEncKey, row.SNwkSIntKey, row.FNwkSIntKey,
+		formatFCnt(row.FCntUp), formatFCnt(row.FCntDown), row.Error,
+	}
+}
+
+func formatFCnt(fCnt *uint32) string {
+	if fCnt == nil {
+		return ""
+	}
+	return strconv.FormatUint(uint64(*fCnt), 10)
+}
+
+func (row *ExportRow) redact() {
+	for _, key := range []*string{&row.AppKey, &row.NwkKey, &row.AppSKey, &row.NwkSEncKey, &row.SNwkSIntKey, &row.FNwkSIntKey} {
+		if *key != "" {
+			*key = redacted
+		}
+	}
+}
+
+// writeExportCSV writes the export rows as CSV with a header line.
+func writeExportCSV(w io.Writer, rows []ExportRow) error {
+	writer := csv.NewWriter(w)
+	writer.Write(exportCSVHeader)
+	for i := range rows {
+		writer.Write(rows[i].csv())
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// exportDevices lists all linked devices with their activation state. The keys are
+// redacted unless withKeys is set. Devices that can not be read from ChirpStack are
+// exported with an error.
+func exportDevices(withKeys bool) ([]ExportRow, error) {
+	ctx := context.Background()
+
+	log.Println("--- Export devices")
+
+	devices, err := wazigate.GetDevices(&waziup.DevicesQuery{
+		Meta: []string{"lorawan"},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("can not get LoRaWAN devices: %v", err)
+	}
+	devicesByID := make(map[string]*waziup.Device, len(devices))
+	for i := range devices {
+		devicesByID[devices[i].ID] = &devices[i]
+	}
+
+	conn, err := connectToChirpStack()
+	if err != nil {
+		return nil, fmt.Errorf("grpc: can not connect to ChirpStack: %v", err)
+	}
+	defer conn.Close()
+
+	deviceClient := asAPI.NewDeviceServiceClient(conn)
+	deviceProfileService := asAPI.NewDeviceProfileServiceClient(conn)
+	profiles := make(map[string]*asAPI.DeviceProfile)
+
+	entries := registry.All()
+	rows := make([]ExportRow, len(entries))
+	for i, entry := range entries {
+		row := &rows[i]
+		row.ID = entry.ID
+		row.DevEUI = fmt.Sprintf("%016X", entry.DevEUI)
+		if device := devicesByID[entry.ID]; device != nil {
+			row.Name = device.Name
+			row.Profile, _ = device.Meta.Get("lorawan").Get("profile").String()
+		}
+
+		r, err := deviceClient.Get(ctx, &asAPI.GetDeviceRequest{
+			DevEui: row.DevEUI,
+		})
+		if err != nil {
+			row.Error = fmt.Sprintf("can not get ChirpStack device: %v", err)
+			continue
+		}
+		row.JoinEUI = r.Device.JoinEui
+		deviceProfile := profiles[r.Device.DeviceProfileId]
+		if deviceProfile == nil {
+			resp, err := deviceProfileService.Get(ctx, &asAPI.GetDeviceProfileRequest{
+				Id: r.Device.DeviceProfileId,
+			})
+			if err != nil {
+				row.Error = fmt.Sprintf("can not get ChirpStack device-profile: %v", err)
+				continue
+			}
+			deviceProfile = resp.DeviceProfile
+			profiles[deviceProfile.Id] = deviceProfile
+		}
+		if row.Profile == "" {
+			row.Profile = deviceProfile.Name
+		}
+		isLoRaWAN11 := deviceProfile.MacVersion == common.MacVersion_LORAWAN_1_1_0
+
+		if keys, err := deviceClient.GetKeys(ctx, &asAPI.GetDeviceKeysRequest{
+			DevEui: row.DevEUI,
+		}); err == nil {
+			if isLoRaWAN11 {
+				row.AppKey = keys.DeviceKeys.AppKey
+				row.NwkKey = keys.DeviceKeys.NwkKey
+			} else {
+				// ChirpStack stores the LoRaWAN 1.0.x AppKey as NwkKey
+				row.AppKey = keys.DeviceKeys.NwkKey
+			}
+		}
+
+		activation, err := deviceClient.GetActivation(ctx, &asAPI.GetDeviceActivationRequest{
+			DevEui: row.DevEUI,
+		})
+		if err != nil {
+			row.Error = fmt.Sprintf("can not get ChirpStack device activation: %v", err)
+		} else if a := activation.DeviceActivation; a != nil {
+			row.DevAddr = a.DevAddr
+			row.AppSKey = a.AppSKey
+			row.NwkSEncKey = a.NwkSEncKey
+			if isLoRaWAN11 {
+				row.SNwkSIntKey = a.SNwkSIntKey
+				row.FNwkSIntKey = a.FNwkSIntKey
+			}
+			fCntUp, fCntDown := a.FCntUp, a.NFCntDown
+			row.FCntUp = &fCntUp
+			row.FCntDown = &fCntDown
+		}
+	}
+
+	if !withKeys {
+		for i := range rows {
+			rows[i].redact()
+		}
+	}
+	return rows, nil
+}
@@ -0,0 +1,241 @@
+package app
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/Waziup/wazigate-lora/internal/pkg/wazigate"
+	"github.com/Waziup/wazigate-lora/internal/pkg/waziup"
+)
+
+// ImportRow is one device of a bulk import. The LoRaWAN fields are named like the
+// 'lorawan' metadata fields, also in the CSV header.
+type ImportRow struct {
+	Name        string  `json:"name"`
+	DevEUI      string  `json:"devEUI"`
+	Profile     string  `json:"profile"`
+	JoinEUI     string  `json:"joinEUI,omitempty"`
+	AppKey      string  `json:"appKey,omitempty"`
+	NwkKey      string  `json:"nwkKey,omitempty"`
+	DevAddr     string  `json:"devAddr,omitempty"`
+	AppSKey     string  `json:"appSKey,omitempty"`
+	NwkSEncKey  string  `json:"nwkSEncKey,omitempty"`
+	SNwkSIntKey string  `json:"sNwkSIntKey,omitempty"`
+	FNwkSIntKey string  `json:"fNwkSIntKey,omitempty"`
+	FCntUp      *uint32 `json:"fCntUp,omitempty"`
+	FCntDown    *uint32 `json:"fCntDown,omitempty"`
+}
+
+// ImportResult is the outcome of importing one ImportRow.
+type ImportResult struct {
+	Row    int    `json:"row"`
+	Name   string `json:"name"`
+	DevEUI string `json:"devEUI"`
+	ID     string `json:"id,omitempty"`
+	OK     bool   `json:"ok"`
+	Error  string `json:"error,omitempty"`
+}
+
+// readImportCSV reads import rows from CSV. The first line is the header.
+func readImportCSV(r io.Reader) ([]ImportRow, error) {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("csv: can not read header: %v", err)
+	}
+	var rows []ImportRow
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return rows, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("csv: %v", err)
+		}
+		var row ImportRow
+		for i, column := range header {
+			if i >= len(record) {
+				break
+			}
+			value := strings.TrimSpace(record[i])
+			switch strings.ToLower(strings.TrimSpace(column)) {
+			case "name":
+				row.Name = value
+			case "deveui":
+				row.DevEUI = value
+			case "profile":
+				row.Profile = value
+			case "joineui":
+				row.JoinEUI = value
+			case "appkey":
+				row.AppKey = value
+			case "nwkkey":
+				row.NwkKey = value
+			case "devaddr":
+				row.DevAddr = value
+			case "appskey":
+				row.AppSKey = value
+			case "nwksenckey":
+				row.NwkSEncKey = value
+			case "snwksintkey":
+				row.SNwkSIntKey = value
+			case "fnwksintkey":
+				row.FNwkSIntKey = value
+			case "fcntup":
+				if row.FCntUp, err = parseFCnt(value); err != nil {
+					return nil, fmt.Errorf("csv: row %d: fCntUp: %v", len(rows)+1, err)
+				}
+			case "fcntdown":
+				if row.FCntDown, err = parseFCnt(value); err != nil {
+					return nil, fmt.Errorf("csv: row %d: fCntDown: %v", len(rows)+1, err)
+				}
+			}
+		}
+		rows = append(rows, row)
+	}
+}
+
+// parseFCnt parses an optional frame counter, nil if empty.
+func parseFCnt(value string) (*uint32, error) {
+	if value == "" {
+		return nil, nil
+	}
+	n, err := strconv.ParseUint(value, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	fCnt := uint32(n)
+	return &fCnt, nil
+}
+
+// readImportJSON reads import rows from a JSON array.
+func readImportJSON(r io.Reader) ([]ImportRow, error) {
+	var rows []ImportRow
+	if err := json.NewDecoder(r).Decode(&rows); err != nil {
+		return nil, fmt.Errorf("json: %v", err)
+	}
+	return rows, nil
+}
+
+// validate checks the DevEUI, the hex lengths of the EUIs and keys and that the row
+// has either OTAA or ABP keys.
+func (row *ImportRow) validate() error {
+	if _, err := strconv.ParseUint(row.DevEUI, 16, 64); err != nil || len(row.DevEUI) != 16 {
+		return fmt.Errorf("invalid devEUI %q", row.DevEUI)
+	}
+	for _, field := range []struct {
+		name  string
+		value string
+		size  int
+	}{
+		{"joinEUI", row.JoinEUI, 8},
+		{"appKey", row.AppKey, 16},
+		{"nwkKey", row.NwkKey, 16},
+		{"devAddr", row.DevAddr, 4},
+		{"appSKey", row.AppSKey, 16},
+		{"nwkSEncKey", row.NwkSEncKey, 16},
+		{"sNwkSIntKey", row.SNwkSIntKey, 16},
+		{"fNwkSIntKey", row.FNwkSIntKey, 16},
+	} {
+		if field.value == "" {
+			continue
+		}
+		if err := checkHex(field.name, field.value, field.size); err != nil {
+			return err
+		}
+	}
+	if row.AppKey != "" {
+		return nil
+	}
+	if row.DevAddr == "" || row.AppSKey == "" || row.NwkSEncKey == "" {
+		return fmt.Errorf("either appKey (OTAA) or devAddr, appSKey and nwkSEncKey (ABP) are required")
+	}
+	return nil
+}
+
+// meta returns the Wazigate device metadata for the row.
+func (row *ImportRow) meta() waziup.Meta {
+	lorawan := map[string]interface{}{
+		"devEUI":  row.DevEUI,
+		"profile": row.Profile,
+	}
+	for key, value := range map[string]string{
+		"joinEUI":     row.JoinEUI,
+		"appKey":      row.AppKey,
+		"nwkKey":      row.NwkKey,
+		"devAddr":     row.DevAddr,
+		"appSKey":     row.AppSKey,
+		"nwkSEncKey":  row.NwkSEncKey,
+		"sNwkSIntKey": row.SNwkSIntKey,
+		"fNwkSIntKey": row.FNwkSIntKey,
+	} {
+		if value != "" {
+			lorawan[key] = value
+		}
+	}
+	if row.FCntUp != nil {
+		lorawan["fCntUp"] = *row.FCntUp
+	}
+	if row.FCntDown != nil {
+		lorawan["fCntDown"] = *row.FCntDown
+	}
+	return waziup.Meta{"lorawan": lorawan}
+}
+
+// importDevices creates a Wazigate device with 'lorawan' metadata for each row and
+// provisions the ChirpStack device. Rows are independent: a failing row does not
+// stop the import.
+func importDevices(rows []ImportRow) []ImportResult {
+	log.Printf("--- Import %d devices", len(rows))
+
+	results := make([]ImportResult, len(rows))
+	for i := range rows {
+		row := &rows[i]
+		result := &results[i]
+		result.Row = i + 1
+		result.Name = row.Name
+		result.DevEUI = row.DevEUI
+
+		if row.Profile == "" {
+			row.Profile = "WaziDev"
+		}
+		if row.Name == "" {
+			row.Name = row.DevEUI
+		}
+		if err := row.validate(); err != nil {
+			result.Error = err.Error()
+			continue
+		}
+		devEUI, _ := strconv.ParseUint(row.DevEUI, 16, 64)
+		if entry, ok := registry.ByDevEUI(devEUI); ok {
+			result.Error = fmt.Sprintf("the devEUI is already used by device %q", entry.ID)
+			continue
+		}
+		if _, err := resolveDeviceProfile(row.Profile); err != nil {
+			result.Error = err.Error()
+			continue
+		}
+
+		device := waziup.Device{
+			Name: row.Name,
+			Meta: row.meta(),
+		}
+		if err := wazigate.AddDevice(&device); err != nil {
+			result.Error = fmt.Sprintf("can not create Wazigate device: %v", err)
+			continue
+		}
+		result.ID = device.ID
+		if err := checkWaziupDevice(device.ID, device.Meta); err != nil {
+			result.Error = fmt.Sprintf("can not provision ChirpStack device: %v", err)
+			continue
+		}
+		result.OK = true
+	}
+	return results
+}
@@ -11,11 +11,22 @@
 //	     "nwkSEncKey": "d83cb057cebd2c43e21f4cde01c19ae1",
 //	   }
 //	}
+//
+// Devices using Over-The-Air Activation (OTAA) provide an 'appKey' (and optionally
+// 'nwkKey' and 'joinEUI') instead of the ABP 'devAddr', 'appSKey' and 'nwkSEncKey':
+//
+//	{
+//	  "lorawan": {
+//	     "devEUI": "AA555A0026011d87",
+//	     "profile": "WaziDev",
+//	     "joinEUI": "0000000000000000",
+//	     "appKey": "23158d3bbc31e6af670d195b5aed5525",
+//	   }
+//	}
 package app
 
 import (
 	"bytes"
-	"context"
 	"encoding/base64"
 	"encoding/binary"
 	"encoding/hex"
@@ -23,19 +34,23 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"reflect"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/Waziup/wazigate-lora/internal/pkg/waziapp"
 	"github.com/Waziup/wazigate-lora/internal/pkg/wazigate"
 	"github.com/Waziup/wazigate-lora/internal/pkg/waziup"
 	asAPI "github.com/chirpstack/chirpstack/api/go/v4/api"
+	"github.com/chirpstack/chirpstack/api/go/v4/common"
 	gw "github.com/chirpstack/chirpstack/api/go/v4/gw"
 	asIntegr "github.com/chirpstack/chirpstack/api/go/v4/integration"
 
 	"github.com/golang/protobuf/jsonpb"
 	"github.com/golang/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 // var mqttAddr = "127.0.0.1"
@@ -73,6 +88,7 @@ func Serve() error {
 	wazigate.Subscribe("devices/+/actuators/+/value")
 	wazigate.Subscribe("devices/+/actuators/+/values")
 	wazigate.Subscribe("devices/+/meta")
+	wazigate.Subscribe("devices/+")
 	wazigate.Subscribe("devices")
 	for {
 		msg, err := wazigate.Message()
@@ -93,6 +109,23 @@ func Serve() error {
 			}
 			checkWaziupDevice(device.ID, device.Meta)
 
+			// Topic: devices/+
+		} else if len(topic) == 2 && topic[0] == "devices" {
+			// A device was changed or deleted. The message does not tell us which, so we
+			// ask the Wazigate Edge if the device still exists.
+
+			id := topic[1]
+			if _, ok := registry.ByID(id); !ok {
+				continue
+			}
+			if _, err := wazigate.GetDevice(id); err != nil {
+				if waziup.IsNotExist(err) {
+					removeWaziupDevice(id)
+				} else {
+					log.Printf("Err Can not get device %q: %v", id, err)
+				}
+			}
+
 			// Topic: devices/+/meta
 		} else if len(topic) == 3 && topic[0] == "devices" && topic[2] == "meta" {
 			// A device's metadata changed. If the device is a LoRaWAN device we will update
@@ -105,6 +138,26 @@ func Serve() error {
 				log.Printf("Err msg: %s", msg.Data)
 				continue
 			}
+			if isLoRaWANRuntimeMeta(meta) {
+				// Only the keys written by this service have been changed.
+				continue
+			}
+			if lorawan := meta.Get("lorawan"); lorawan.Undefined() {
+				// The message might only contain the metadata keys that have been changed,
+				// so we make sure that the 'lorawan' metadata has really been removed.
+				if _, ok := registry.ByID(id); ok {
+					device, err := wazigate.GetDevice(id)
+					if err == nil {
+						meta = device.Meta
+					} else if !waziup.IsNotExist(err) {
+						log.Printf("Err Can not get device %q: %v", id, err)
+						continue
+					}
+				}
+			} else if entry, ok := registry.ByID(id); ok && entry.Provisioned && reflect.DeepEqual(entry.LoRaWAN, lorawanConfig(lorawan)) {
+				// Only the keys written by this service have been changed.
+				continue
+			}
 			checkWaziupDevice(id, meta)
 
 			// Topic: eu868/gateway/+/event/+
@@ -143,6 +196,16 @@ func Serve() error {
 				}
 				log.Printf("Payload: [%d] %s", len(payload), base64Payload)
 
+				// Data-up frames (unconfirmed or confirmed) carry the DevAddr in the frame header.
+				if len(payload) >= 5 && (payload[0]>>5 == 2 || payload[0]>>5 == 4) {
+					devAddr := binary.LittleEndian.Uint32(payload[1:5])
+					if entry, ok := registry.ByDevAddr(devAddr); ok {
+						log.Printf("DevAddr %08X -> Waziup Device %q", devAddr, entry.ID)
+					} else {
+						log.Printf("DevAddr %08X: No Waziup device for that address.", devAddr)
+					}
+				}
+
 			case "txack":
 				log.Printf("Tx completed.")
 				continue
@@ -176,18 +239,29 @@ func Serve() error {
 
 				devEUI := binary.BigEndian.Uint64(bytes)
 
-				devID := devEUIs[devEUI]
-				if devID == "" {
+				entry, ok := registry.ByDevEUI(devEUI)
+				if !ok {
 					log.Printf("ChirpStack DevEUI \"%016X\": No Waziup device for that EUI!", devEUI)
 					break
 				}
+				devID := entry.ID
 
 				log.Printf("ChirpStack DevEUI \"%016X\" -> Waziup Device \"%s\"", devEUI, devID)
 
-				err = wazigate.UnmarshalDevice(devID, uplinkEvt.Data)
+				setUplinkChannel(entry, &uplinkEvt)
+
+				err = postUplink(entry, &uplinkEvt)
 				if err != nil {
 					log.Printf("Err Data upload to wazigate-edge failed: %v", err)
 				}
+				if err = postLinkQuality(entry, &uplinkEvt); err != nil {
+					log.Printf("Err Link quality upload to wazigate-edge failed: %v", err)
+				}
+				if err = setLoRaWANStatus(devID, map[string]interface{}{
+					"lastUplink": eventTime(uplinkEvt.Time),
+				}); err != nil {
+					log.Printf("Err Can not set device status: %v", err)
+				}
 
 			case "status":
 				var statusEvt asIntegr.StatusEvent
@@ -199,6 +273,12 @@ func Serve() error {
 				battery := statusEvt.GetBatteryLevel()
 				log.Printf("Received status from %v: %v Battery", eui, battery)
 
+				if entry, ok := registryEntry(statusEvt.DeviceInfo); ok {
+					if err = postDeviceStatus(entry, &statusEvt); err != nil {
+						log.Printf("Err Device status upload to wazigate-edge failed: %v", err)
+					}
+				}
+
 			case "error":
 				var errorEvt asIntegr.LogEvent
 				if err = Unmarshal(msg.Data, &errorEvt); err != nil {
@@ -209,6 +289,19 @@ func Serve() error {
 				e := errorEvt.Description
 				log.Printf("Received error from %v: %v", eui, e)
 
+				if entry, ok := registryEntry(errorEvt.DeviceInfo); ok {
+					if err = setLoRaWANStatus(entry.ID, map[string]interface{}{
+						"lastError": map[string]interface{}{
+							"time":        eventTime(errorEvt.Time),
+							"level":       errorEvt.Level.String(),
+							"code":        errorEvt.Code.String(),
+							"description": errorEvt.Description,
+						},
+					}); err != nil {
+						log.Printf("Err Can not set device status: %v", err)
+					}
+				}
+
 			case "ack":
 				var ackEvt asIntegr.AckEvent
 				if err = Unmarshal(msg.Data, &ackEvt); err != nil {
@@ -218,6 +311,24 @@ func Serve() error {
 				eui := ackEvt.DeviceInfo.DevEui
 				log.Printf("Received ack from %v", eui)
 
+				if entry, ok := registryEntry(ackEvt.DeviceInfo); ok {
+					if err = setLoRaWANStatus(entry.ID, map[string]interface{}{
+						"lastAck": map[string]interface{}{
+							"time":         eventTime(ackEvt.Time),
+							"queueId":      ackEvt.QueueItemId,
+							"acknowledged": ackEvt.Acknowledged,
+							"fCntDown":     ackEvt.FCntDown,
+						},
+					}); err != nil {
+						log.Printf("Err Can not set device status: %v", err)
+					}
+				}
+				if ackEvt.Acknowledged {
+					updateDelivery(ackEvt.QueueItemId, DeliveryAcknowledged, ackEvt.FCntDown, "")
+				} else {
+					updateDelivery(ackEvt.QueueItemId, DeliveryFailed, ackEvt.FCntDown, "not acknowledged by the device")
+				}
+
 			case "join":
 				var joinEvt asIntegr.JoinEvent
 				if err = Unmarshal(msg.Data, &joinEvt); err != nil {
@@ -227,6 +338,18 @@ func Serve() error {
 				eui := joinEvt.DeviceInfo.DevEui
 				log.Printf("Device %v joined the network.", eui)
 
+				if entry, ok := registryEntry(joinEvt.DeviceInfo); ok {
+					if devAddr, err := strconv.ParseUint(joinEvt.DevAddr, 16, 32); err == nil {
+						registry.SetDevAddr(entry.DevEUI, uint32(devAddr))
+					}
+					if err = setLoRaWANStatus(entry.ID, map[string]interface{}{
+						"joined":  eventTime(joinEvt.Time),
+						"devAddr": strings.ToUpper(joinEvt.DevAddr),
+					}); err != nil {
+						log.Printf("Err Can not set device status: %v", err)
+					}
+				}
+
 			case "txack":
 				var txackEvt asIntegr.TxAckEvent
 				if err = Unmarshal(msg.Data, &txackEvt); err != nil {
@@ -236,14 +359,29 @@ func Serve() error {
 				eui := txackEvt.DeviceInfo.DevEui
 				log.Printf("Received txack from %v", eui)
 
+				if entry, ok := registryEntry(txackEvt.DeviceInfo); ok {
+					if err = setLoRaWANStatus(entry.ID, map[string]interface{}{
+						"lastTxAck": map[string]interface{}{
+							"time":     eventTime(txackEvt.Time),
+							"queueId":  txackEvt.QueueItemId,
+							"fCntDown": txackEvt.FCntDown,
+							"gateway":  txackEvt.GatewayId,
+						},
+					}); err != nil {
+						log.Printf("Err Can not set device status: %v", err)
+					}
+				}
+				updateAirtime(txackEvt.QueueItemId, "")
+				updateDelivery(txackEvt.QueueItemId, DeliveryTransmitted, txackEvt.FCntDown, "")
+
 			default:
 				log.Printf("Unknown MQTT topic %q.", msg.Topic)
 				continue
 
 			}
 
-			// Topic: devices/+/actuators/+/value
-		} else if len(topic) == 5 && topic[0] == "devices" && topic[2] == "actuators" {
+			// Topic: devices/+/actuators/+/value[s]
+		} else if len(topic) == 5 && topic[0] == "devices" && topic[2] == "actuators" && (topic[4] == "value" || topic[4] == "values") {
 
 			log.Println("--- WaziGate Device Actuation")
 
@@ -251,56 +389,74 @@ func Serve() error {
 			// If the actuator belongs to a LoRaWAN device (a device with lorawan metadata)
 			// then we will forward the value as payload to ChirpStack.
 			devID := topic[1]
-			devEUIInt64, ok := waziupID2devEUI(devID)
+			entry, ok := registry.ByID(devID)
 			if !ok {
+				// Virtual devices with 'multicast' metadata actuate a multicast group.
+				if device, err := wazigate.GetDevice(devID); err == nil && !device.Meta.Get("multicast").Undefined() {
+					log.Printf("Waziup Device \"%s\" -> ChirpStack multicast group", devID)
+					if err := sendMulticastActuator(device, topic[3]); err != nil {
+						log.Printf("Err Can not enqueue multicast payload: %v", err)
+					}
+					continue
+				}
 				log.Printf("Waziup Device \"%s\" -> No ChirpStack DevEUI ?? (no matching LoRaWAN device)", devID)
 				continue
 			}
-			log.Printf("Waziup Device \"%s\" -> ChirpStack DevEUI \"%016X\"", devID, devEUIInt64)
+			log.Printf("Waziup Device \"%s\" -> ChirpStack DevEUI \"%016X\"", devID, entry.DevEUI)
 
-			data, err := wazigate.MarshalDevice(devID)
-			if err != nil {
-				log.Printf("Err Can marshal device: %v", err)
+			if isReportedActuator(devID, topic[3]) {
+				log.Printf("The actuator value has been reported by the device, no downlink.")
 				continue
 			}
-			log.Printf("  Payload: [%d] %v", len(data), data)
-			base64Data := base64.StdEncoding.EncodeToString(data)
-			log.Printf("  Base64: [%d] %s", len(base64Data), base64Data)
-			
-			devEUI := fmt.Sprintf("%016X", devEUIInt64)
-			ctx := context.Background()
 
-			conn, err := connectToChirpStack()
+			device, err := wazigate.GetDevice(devID)
+			if err != nil {
+				log.Printf("Err Can not get device: %v", err)
+				continue
+			}
+			actuatorID := topic[3]
+			var actuator *waziup.Actuator
+			for _, a := range device.Actuators {
+				if a.ID == actuatorID {
+					actuator = a
+				}
+			}
+			settings, err := downlinkSettings(entry, actuator)
 			if err != nil {
-				return fmt.Errorf("grpc: can not connect to ChirpStack: %v", err)
+				log.Printf("Err Actuator %q: %v", actuatorID, err)
+				continue
 			}
-			defer conn.Close()
 
-			asDeviceQueueService := asAPI.NewDeviceServiceClient(conn)
-			{
-				_, err := asDeviceQueueService.FlushQueue(ctx, &asAPI.FlushDeviceQueueRequest{
-					DevEui: devEUI,
-				})
+			if topic[4] == "values" && actuator != nil {
+				values, err := parseActuatorValues(msg.Data)
 				if err != nil {
-					log.Printf("Err Can not clear device queue: %v", err)
+					log.Printf("Err Actuator %q: %v", actuatorID, err)
 					continue
 				}
-			}
-			{
-				resp, err := asDeviceQueueService.Enqueue(ctx, &asAPI.EnqueueDeviceQueueItemRequest{
-					QueueItem: &asAPI.DeviceQueueItem{
-						DevEui: devEUI,
-						FPort:  100,
-						Data:   data,
-					},
-				})
-				if err != nil {
+				log.Printf("  Batch: %d values, %s, spacing %ds", len(values), settings.Batch, settings.Spacing)
+				if err = sendActuatorBatch(entry, device, actuator, settings, values); err != nil {
 					log.Printf("Can not enqueue payload: %v", err)
-					continue
 				}
+				continue
+			}
+			nextSequence(devID + "/" + actuatorID)
 
-				log.Printf("Payload enqueued. Id %s", resp.Id)
+			data, err := encodeDownlink(entry, device, actuator, settings.FPort)
+			if err != nil {
+				log.Printf("Err Can not encode downlink: %v", err)
+				continue
+			}
+			log.Printf("  Payload: [%d] %v", len(data), data)
+			base64Data := base64.StdEncoding.EncodeToString(data)
+			log.Printf("  Base64: [%d] %s", len(base64Data), base64Data)
+			log.Printf("  FPort: %d, Confirmed: %v, Queue: %s", settings.FPort, settings.Confirmed, settings.Queue)
+
+			id, err := sendActuatorDownlink(entry, actuatorID, settings, data)
+			if err != nil {
+				log.Printf("Can not enqueue payload: %v", err)
+				continue
 			}
+			log.Printf("Payload enqueued. Id %s", id)
 
 		} else {
 			log.Printf("Unknown MQTT topic %q.", msg.Topic)
@@ -309,6 +465,27 @@ func Serve() error {
 	}
 }
 
+// eventTime returns the time of a ChirpStack event, or now if it has no time.
+func eventTime(t *timestamppb.Timestamp) time.Time {
+	if t == nil {
+		return time.Now()
+	}
+	return t.AsTime()
+}
+
+// registryEntry returns the registry entry of the device of a ChirpStack event.
+func registryEntry(deviceInfo *asIntegr.DeviceInfo) (RegistryEntry, bool) {
+	devEUI, err := strconv.ParseUint(deviceInfo.GetDevEui(), 16, 64)
+	if err != nil {
+		return RegistryEntry{}, false
+	}
+	entry, ok := registry.ByDevEUI(devEUI)
+	if !ok {
+		log.Printf("ChirpStack DevEUI \"%016X\": No Waziup device for that EUI!", devEUI)
+	}
+	return entry, ok
+}
+
 // Marshal calls protocol buffer's JSON marshaler.
 func Marshal(msg proto.Message) ([]byte, error) {
 	var marshaler jsonpb.Marshaler
@@ -324,8 +501,6 @@ func Unmarshal(data []byte, msg proto.Message) error {
 	return unmarshaler.Unmarshal(bytes.NewReader(data), msg)
 }
 
-var devEUIs = map[uint64]string{}
-
 func InitDevice() {
 
 	log.Println("--- Init Device")
@@ -353,12 +528,24 @@ func InitDevice() {
 			continue
 		}
 
+		// The registry might have been loaded from disk, so we remove all links to
+		// devices that have been deleted while this service was not running first, so
+		// that their DevEUIs can be linked to other devices.
+		ids := make(map[string]struct{}, len(devices))
+		for _, device := range devices {
+			ids[device.ID] = struct{}{}
+		}
+		for _, entry := range registry.All() {
+			if _, ok := ids[entry.ID]; !ok {
+				log.Printf("Waziup Device %q does not exist anymore.", entry.ID)
+				removeWaziupDevice(entry.ID)
+			}
+		}
 		for _, device := range devices {
-
 			checkWaziupDevice(device.ID, device.Meta)
 		}
 
-		log.Printf("There are %d LoRaWAN devices.", len(devEUIs))
+		log.Printf("There are %d LoRaWAN devices.", registry.Len())
 
 		// read device lora settings from /device/meta
 
@@ -386,19 +573,43 @@ func InitDevice() {
 	}
 }
 
-func waziupID2devEUI(id string) (uint64, bool) {
-	for devEUI, _id := range devEUIs {
-		if _id == id {
-			return devEUI, true
-		}
+// removeWaziupDevice removes the ChirpStack device of a Wazigate device that has
+// been deleted or no longer has 'lorawan' metadata.
+func removeWaziupDevice(id string) {
+	entry, ok := registry.Remove(id)
+	if !ok {
+		return
 	}
-	return 0, false
+	devEUI := fmt.Sprintf("%016X", entry.DevEUI)
+	log.Printf("DevEUI %s -> Waziup ID %s removed", devEUI, id)
+	removeChirpstackDevice(devEUI)
+}
+
+// provisioning serializes the provisioning of each DevEUI, as a device can be checked
+// by an import or a reconciliation and by its Wazigate event at the same time.
+var provisioning = struct {
+	sync.Mutex
+	locks map[uint64]*sync.Mutex
+}{locks: make(map[uint64]*sync.Mutex)}
+
+// lockDevEUI locks the provisioning of a DevEUI and returns the unlock function.
+func lockDevEUI(devEUI uint64) func() {
+	provisioning.Lock()
+	mutex := provisioning.locks[devEUI]
+	if mutex == nil {
+		mutex = new(sync.Mutex)
+		provisioning.locks[devEUI] = mutex
+	}
+	provisioning.Unlock()
+	mutex.Lock()
+	return mutex.Unlock
 }
 
 func checkWaziupDevice(id string, meta waziup.Meta) error {
 
 	lorawan := meta.Get("lorawan")
 	if lorawan.Undefined() {
+		removeWaziupDevice(id)
 		return nil
 	}
 	devEUI, err := lorawan.Get("devEUI").String()
@@ -411,32 +622,135 @@ func checkWaziupDevice(id string, meta waziup.Meta) error {
 		log.Printf("Err Device %q DevEUI: invalid value %q", id, devEUI)
 		return nil
 	}
-	devEUIs[devEUIInt64] = id
+	unlock := lockDevEUI(devEUIInt64)
+	defer unlock()
+	if entry, ok := registry.ByID(id); ok && entry.DevEUI != devEUIInt64 {
+		// The DevEUI changed, so the old ChirpStack device must not route data here anymore.
+		removeWaziupDevice(id)
+	}
+	var devAddrInt32 uint32
+	if devAddr, err := lorawan.Get("devAddr").String(); err == nil {
+		if i, err := strconv.ParseUint(devAddr, 16, 32); err == nil {
+			devAddrInt32 = uint32(i)
+		}
+	}
+	if err := registry.Set(id, devEUIInt64, devAddrInt32, lorawan); err != nil {
+		log.Printf("Err Device %q DevEUI: %v", id, err)
+		return err
+	}
 	log.Printf("DevEUI %s -> Waziup ID %s", devEUI, id)
-	profile, err := lorawan.Get("profile").String()
-	if err != nil {
+	if err := provisionDevice(id, devEUI, lorawan); err != nil {
+		return err
+	}
+	registry.SetProvisioned(id)
+	return nil
+}
+
+// provisionDevice creates or updates the ChirpStack device of a Wazigate device,
+// with its OTAA keys or ABP activation.
+func provisionDevice(id string, devEUI string, lorawan waziup.JSON) error {
+	if _, err := lorawan.Get("profile").String(); err != nil {
 		log.Printf("Err Device %q profile: %v", id, err)
 		return nil
 	}
-	if profile == "WaziDev" {
-		if err = setDeviceProfileWaziDev(devEUI, id); err == nil {
-			devAddr, err := lorawan.Get("devAddr").String()
-			if err != nil {
-				log.Printf("Warn Device %q not activated: devAddr: %v", id, err)
-				return nil
-			}
-			appSKey, err := lorawan.Get("appSKey").String()
-			if err != nil {
-				log.Printf("Warn Device %q not activated: appSKey: %v", id, err)
-				return nil
-			}
-			nwkSEncKey, err := lorawan.Get("nwkSEncKey").String()
-			if err != nil {
-				log.Printf("Warn Device %q not activated: nwkSEncKey: %v", id, err)
-				return nil
-			}
-			setWaziDevActivation(devEUI, devAddr, nwkSEncKey, appSKey)
-		}
+	deviceProfile, err := resolveLoRaWANProfile(lorawan, true)
+	if err != nil {
+		log.Printf("Err Device %q profile: %v", id, err)
+		return err
+	}
+	// Devices with an appKey use Over-The-Air Activation (OTAA) and
+	// will receive their session keys when joining the network.
+	appKey, err := lorawan.Get("appKey").String()
+	isOTAA := err == nil
+	if isOTAA && !deviceProfile.SupportsOtaa {
+		err := fmt.Errorf("device-profile %q does not support OTAA", deviceProfile.Name)
+		log.Printf("Err Device %q profile: %v", id, err)
+		return err
+	}
+	// The joinEUI is optional for OTAA devices, so an empty value is fine.
+	joinEUI, _ := lorawan.Get("joinEUI").String()
+	// The frame counter check protects against replays. Devices that reset their
+	// frame counters on reboot can opt out with 'skipFCntCheck'.
+	skipFCntCheck, _ := lorawan.Get("skipFCntCheck").Bool()
+	err = setDevice(id, &asAPI.Device{
+		DevEui:          devEUI,
+		JoinEui:         joinEUI,
+		DeviceProfileId: deviceProfile.Id,
+		SkipFcntCheck:   skipFCntCheck,
+	})
+	if err != nil {
+		return err
+	}
+	if isOTAA {
+		nwkKey, _ := lorawan.Get("nwkKey").String()
+		return setWaziDevKeys(devEUI, nwkKey, appKey)
+	}
+	activation, err := readActivation(devEUI, lorawan, deviceProfile.MacVersion)
+	if err != nil {
+		log.Printf("Warn Device %q not activated: %v", id, err)
+		return err
+	}
+	// Counters from the metadata are only set once, and again when they are changed.
+	// Otherwise every restart would rewind the counters to the metadata values.
+	fCnt := readFrameCounters(lorawan)
+	entry, _ := registry.ByID(id)
+	if err = setWaziDevActivation(activation, fCnt, entry.FCnt); err != nil {
+		return err
 	}
+	registry.SetFrameCounters(id, fCnt)
 	return nil
 }
+
+// readFrameCounters reads the optional 'fCntUp' and 'fCntDown' frame counters
+// from the 'lorawan' metadata.
+func readFrameCounters(lorawan waziup.JSON) (fCnt frameCounters) {
+	if n, err := lorawan.Get("fCntUp").Int(); err == nil && n >= 0 {
+		up := uint32(n)
+		fCnt.up = &up
+	}
+	if n, err := lorawan.Get("fCntDown").Int(); err == nil && n >= 0 {
+		down := uint32(n)
+		fCnt.down = &down
+	}
+	return
+}
+
+// readActivation reads the Activation By Personalization (ABP) session keys from
+// the 'lorawan' metadata. LoRaWAN 1.1 devices have separate network session keys,
+// for LoRaWAN 1.0.x devices all of them are the 'nwkSEncKey'.
+func readActivation(devEUI string, lorawan waziup.JSON, macVersion common.MacVersion) (*asAPI.DeviceActivation, error) {
+	devAddr, err := lorawan.Get("devAddr").String()
+	if err != nil {
+		return nil, fmt.Errorf("devAddr: %v", err)
+	}
+	appSKey, err := lorawan.Get("appSKey").String()
+	if err != nil {
+		return nil, fmt.Errorf("appSKey: %v", err)
+	}
+	nwkSEncKey, err := lorawan.Get("nwkSEncKey").String()
+	if err != nil {
+		return nil, fmt.Errorf("nwkSEncKey: %v", err)
+	}
+	sNwkSIntKey, _ := lorawan.Get("sNwkSIntKey").String()
+	fNwkSIntKey, _ := lorawan.Get("fNwkSIntKey").String()
+	if macVersion == common.MacVersion_LORAWAN_1_1_0 {
+		if sNwkSIntKey == "" || fNwkSIntKey == "" {
+			return nil, fmt.Errorf("sNwkSIntKey and fNwkSIntKey are required for %v", macVersion)
+		}
+	} else {
+		if (sNwkSIntKey != "" && !strings.EqualFold(sNwkSIntKey, nwkSEncKey)) ||
+			(fNwkSIntKey != "" && !strings.EqualFold(fNwkSIntKey, nwkSEncKey)) {
+			return nil, fmt.Errorf("sNwkSIntKey and fNwkSIntKey are only supported for LoRaWAN 1.1, but the device-profile uses %v", macVersion)
+		}
+		sNwkSIntKey = nwkSEncKey
+		fNwkSIntKey = nwkSEncKey
+	}
+	return &asAPI.DeviceActivation{
+		DevEui:      devEUI,
+		DevAddr:     devAddr,
+		AppSKey:     appSKey,
+		NwkSEncKey:  nwkSEncKey,
+		SNwkSIntKey: sNwkSIntKey,
+		FNwkSIntKey: fNwkSIntKey,
+	}, nil
+}
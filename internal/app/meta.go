@@ -1,6 +1,14 @@
 package app
 
-import "log"
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"strings"
+
+	"github.com/Waziup/wazigate-lora/internal/pkg/wazigate"
+	"github.com/Waziup/wazigate-lora/internal/pkg/waziup"
+)
 
 // Meta is device metadata.
 type LoRaWANMeta struct {
@@ -37,3 +45,80 @@ func setMeta(lora *WazigateLora) {
 	fwd.exec = "forwader/" + lora.Forwarder
 	setForwarder(fwd)
 }
+
+////////////////////////////////////////////////////////////////////////////////
+
+// lorawanRuntimeKeys are the keys of the 'lorawan' device metadata that are written
+// by this service. Changing them does not change the LoRaWAN device.
+var lorawanRuntimeKeys = []string{"link", "status", "battery"}
+
+// lorawanKeys are the LoRaWAN keys of the 'lorawan' device metadata. They are only
+// kept as hashes, to detect changes without storing the keys.
+var lorawanKeys = []string{"appKey", "nwkKey", "appSKey", "nwkSEncKey", "sNwkSIntKey", "fNwkSIntKey"}
+
+const keyHashPrefix = "sha256:"
+
+// lorawanConfig returns the 'lorawan' metadata without the runtime keys and with
+// hashes instead of the LoRaWAN keys.
+func lorawanConfig(lorawan waziup.JSON) map[string]interface{} {
+	m, ok := lorawan.Value().(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	config := make(map[string]interface{}, len(m))
+	for key, value := range m {
+		config[key] = value
+	}
+	for _, key := range lorawanRuntimeKeys {
+		delete(config, key)
+	}
+	for _, key := range lorawanKeys {
+		if value, ok := config[key].(string); ok && !strings.HasPrefix(value, keyHashPrefix) {
+			hash := sha256.Sum256([]byte(strings.ToUpper(value)))
+			config[key] = keyHashPrefix + hex.EncodeToString(hash[:])
+		}
+	}
+	return config
+}
+
+// setLoRaWANMeta sets a runtime key of the 'lorawan' metadata of a device. The key is
+// written as 'lorawan.<key>', which the Wazigate Edge sets as a nested field with
+// MongoDB, so the metadata is not read first and concurrent edits of the other fields
+// of the 'lorawan' metadata are kept.
+func setLoRaWANMeta(devID string, key string, value interface{}) error {
+	return wazigate.SetMeta(devID, waziup.Meta{"lorawan." + key: value})
+}
+
+// setLoRaWANStatus sets fields of the 'lorawan.status' metadata of a device, each as a
+// nested field like setLoRaWANMeta. Other fields of the status are kept.
+func setLoRaWANStatus(devID string, fields map[string]interface{}) error {
+	meta := make(waziup.Meta, len(fields))
+	for key, value := range fields {
+		meta["lorawan.status."+key] = value
+	}
+	return wazigate.SetMeta(devID, meta)
+}
+
+// isLoRaWANRuntimeMeta tells if changed device metadata only has runtime keys of the
+// 'lorawan' metadata, as written by setLoRaWANMeta and setLoRaWANStatus.
+func isLoRaWANRuntimeMeta(meta waziup.Meta) bool {
+	if len(meta) == 0 {
+		return false
+	}
+	for key := range meta {
+		path := strings.Split(key, ".")
+		if len(path) < 2 || path[0] != "lorawan" || !isLoRaWANRuntimeKey(path[1]) {
+			return false
+		}
+	}
+	return true
+}
+
+func isLoRaWANRuntimeKey(key string) bool {
+	for _, k := range lorawanRuntimeKeys {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,475 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Waziup/wazigate-lora/internal/pkg/wazigate"
+	"github.com/Waziup/wazigate-lora/internal/pkg/waziup"
+	asAPI "github.com/chirpstack/chirpstack/api/go/v4/api"
+	"github.com/chirpstack/chirpstack/api/go/v4/common"
+)
+
+// MulticastGroup is a ChirpStack multicast group of the application, with the
+// Wazigate devices (or DevEUIs of unlinked devices) that are members.
+type MulticastGroup struct {
+	ID     string `json:"id,omitempty"`
+	Name   string `json:"name"`
+	McAddr string `json:"mcAddr"`
+	// The session keys are only set, never returned.
+	McNwkSKey string `json:"mcNwkSKey,omitempty"`
+	McAppSKey string `json:"mcAppSKey,omitempty"`
+	// Class is "B" or "C" (default).
+	Class          string   `json:"class,omitempty"`
+	PingSlotPeriod int      `json:"pingSlotPeriod,omitempty"`
+	DR             uint32   `json:"dr"`
+	Frequency      uint32   `json:"frequency,omitempty"`
+	FCnt           uint32   `json:"fCnt"`
+	Devices        []string `json:"devices,omitempty"`
+}
+
+// MulticastKeys are the session keys of a multicast group.
+type MulticastKeys struct {
+	McAddr    string `json:"mcAddr"`
+	McNwkSKey string `json:"mcNwkSKey"`
+	McAppSKey string `json:"mcAppSKey"`
+}
+
+func (keys *MulticastKeys) validate() error {
+	if err := checkHex("mcAddr", keys.McAddr, 4); err != nil {
+		return err
+	}
+	if err := checkHex("mcNwkSKey", keys.McNwkSKey, 16); err != nil {
+		return err
+	}
+	return checkHex("mcAppSKey", keys.McAppSKey, 16)
+}
+
+func checkHex(name string, value string, size int) error {
+	if len(value) != 2*size {
+		return fmt.Errorf("%s must have %d hex digits", name, 2*size)
+	}
+	if _, err := strconv.ParseUint(value[:size], 16, 64); err != nil {
+		return fmt.Errorf("%s is not hex", name)
+	}
+	if _, err := strconv.ParseUint(value[size:], 16, 64); err != nil {
+		return fmt.Errorf("%s is not hex", name)
+	}
+	return nil
+}
+
+// multicastGroup returns the ChirpStack multicast group, with the defaults for
+// the region of the built-in device profile.
+func (group *MulticastGroup) multicastGroup() (*asAPI.MulticastGroup, error) {
+	keys := MulticastKeys{group.McAddr, group.McNwkSKey, group.McAppSKey}
+	if err := keys.validate(); err != nil {
+		return nil, err
+	}
+	mg := &asAPI.MulticastGroup{
+		Id:            group.ID,
+		Name:          group.Name,
+		ApplicationId: Config.Application.Id,
+		Region:        common.Region_EU868,
+		McAddr:        group.McAddr,
+		McNwkSKey:     group.McNwkSKey,
+		McAppSKey:     group.McAppSKey,
+		FCnt:          group.FCnt,
+		GroupType:     asAPI.MulticastGroupType_CLASS_C,
+		Dr:            group.DR,
+		Frequency:     group.Frequency,
+	}
+	if len(Config.DeviceProfiles) != 0 {
+		mg.Region = Config.DeviceProfiles[0].Region
+	}
+	if mg.Frequency == 0 {
+		if mg.Region != common.Region_EU868 {
+			return nil, fmt.Errorf("the multicast group has no frequency")
+		}
+		mg.Frequency = rx2Frequency
+	}
+	switch strings.ToUpper(group.Class) {
+	case "", ClassC:
+	case ClassB:
+		class := DeviceClass{Class: ClassB, PingSlotPeriod: group.PingSlotPeriod}
+		if class.PingSlotPeriod == 0 {
+			class.PingSlotPeriod = defaultPingSlotPeriod
+		}
+		k, err := pingSlotNbK(class.PingSlotPeriod)
+		if err != nil {
+			return nil, err
+		}
+		mg.GroupType = asAPI.MulticastGroupType_CLASS_B
+		mg.ClassBPingSlotPeriod = k
+	default:
+		return nil, fmt.Errorf("unknown multicast class %q, must be B or C", group.Class)
+	}
+	return mg, nil
+}
+
+// multicastDevEUI returns the DevEUI of a Wazigate device ID or a DevEUI.
+func multicastDevEUI(id string) (string, error) {
+	entry, err := queueDevice(id)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%016X", entry.DevEUI), nil
+}
+
+// listMulticastGroups lists the multicast groups of the application.
+func listMulticastGroups() ([]*asAPI.MulticastGroupListItem, error) {
+	conn, err := connectToChirpStack()
+	if err != nil {
+		return nil, fmt.Errorf("grpc: can not connect to ChirpStack: %v", err)
+	}
+	defer conn.Close()
+
+	multicastService := asAPI.NewMulticastGroupServiceClient(conn)
+	resp, err := multicastService.List(context.Background(), &asAPI.ListMulticastGroupsRequest{
+		Limit:         1000,
+		ApplicationId: Config.Application.Id,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("grpc: can not list multicast groups: %v", err)
+	}
+	return resp.Result, nil
+}
+
+// resolveMulticastGroup finds a multicast group of the application by its ID or name.
+func resolveMulticastGroup(group string) (string, error) {
+	groups, err := listMulticastGroups()
+	if err != nil {
+		return "", err
+	}
+	id := ""
+	for _, mg := range groups {
+		if mg.Id == group {
+			return mg.Id, nil
+		}
+		if id == "" && strings.EqualFold(mg.Name, group) {
+			id = mg.Id
+		}
+	}
+	if id == "" {
+		return "", fmt.Errorf("unknown multicast group %q", group)
+	}
+	return id, nil
+}
+
+// createMulticastGroup creates a multicast group with its devices and the gateway,
+// and returns its ID.
+func createMulticastGroup(group *MulticastGroup) (string, error) {
+	ctx := context.Background()
+
+	mg, err := group.multicastGroup()
+	if err != nil {
+		return "", err
+	}
+	mg.Id = ""
+	devEUIs := make([]string, len(group.Devices))
+	for i, id := range group.Devices {
+		if devEUIs[i], err = multicastDevEUI(id); err != nil {
+			return "", err
+		}
+	}
+
+	conn, err := connectToChirpStack()
+	if err != nil {
+		return "", fmt.Errorf("grpc: can not connect to ChirpStack: %v", err)
+	}
+	defer conn.Close()
+
+	multicastService := asAPI.NewMulticastGroupServiceClient(conn)
+	resp, err := multicastService.Create(ctx, &asAPI.CreateMulticastGroupRequest{
+		MulticastGroup: mg,
+	})
+	if err != nil {
+		return "", fmt.Errorf("grpc: can not create multicast group: %v", err)
+	}
+	log.Printf("Multicast group %q has been created. ID: %v", mg.Name, resp.Id)
+	if Config.Gateway.GatewayId != "" {
+		if _, err := multicastService.AddGateway(ctx, &asAPI.AddGatewayToMulticastGroupRequest{
+			MulticastGroupId: resp.Id,
+			GatewayId:        Config.Gateway.GatewayId,
+		}); err != nil {
+			log.Printf("Err Can not add the gateway to multicast group %q: %v", mg.Name, err)
+		}
+	}
+	for _, devEUI := range devEUIs {
+		if _, err := multicastService.AddDevice(ctx, &asAPI.AddDeviceToMulticastGroupRequest{
+			MulticastGroupId: resp.Id,
+			DevEui:           devEUI,
+		}); err != nil {
+			return resp.Id, fmt.Errorf("grpc: can not add device %s to multicast group: %v", devEUI, err)
+		}
+	}
+	return resp.Id, nil
+}
+
+// getMulticastGroup returns a multicast group with its devices, without session keys.
+func getMulticastGroup(id string) (*MulticastGroup, error) {
+	ctx := context.Background()
+
+	conn, err := connectToChirpStack()
+	if err != nil {
+		return nil, fmt.Errorf("grpc: can not connect to ChirpStack: %v", err)
+	}
+	defer conn.Close()
+
+	multicastService := asAPI.NewMulticastGroupServiceClient(conn)
+	resp, err := multicastService.Get(ctx, &asAPI.GetMulticastGroupRequest{
+		Id: id,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("grpc: can not get multicast group: %v", err)
+	}
+	mg := resp.MulticastGroup
+	group := &MulticastGroup{
+		ID:        mg.Id,
+		Name:      mg.Name,
+		McAddr:    mg.McAddr,
+		Class:     ClassC,
+		DR:        mg.Dr,
+		Frequency: mg.Frequency,
+		FCnt:      mg.FCnt,
+		Devices:   []string{},
+	}
+	if mg.GroupType == asAPI.MulticastGroupType_CLASS_B {
+		group.Class = ClassB
+		group.PingSlotPeriod = beaconPeriod >> mg.ClassBPingSlotPeriod
+	}
+
+	deviceService := asAPI.NewDeviceServiceClient(conn)
+	devices, err := deviceService.List(ctx, &asAPI.ListDevicesRequest{
+		Limit:            1000,
+		ApplicationId:    Config.Application.Id,
+		MulticastGroupId: id,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("grpc: can not list devices of multicast group: %v", err)
+	}
+	for _, device := range devices.Result {
+		member := device.DevEui
+		if devEUI, err := strconv.ParseUint(device.DevEui, 16, 64); err == nil {
+			if entry, ok := registry.ByDevEUI(devEUI); ok {
+				member = entry.ID
+			}
+		}
+		group.Devices = append(group.Devices, member)
+	}
+	return group, nil
+}
+
+// deleteMulticastGroup deletes a multicast group.
+func deleteMulticastGroup(id string) error {
+	conn, err := connectToChirpStack()
+	if err != nil {
+		return fmt.Errorf("grpc: can not connect to ChirpStack: %v", err)
+	}
+	defer conn.Close()
+
+	multicastService := asAPI.NewMulticastGroupServiceClient(conn)
+	queue, err := multicastService.ListQueue(context.Background(), &asAPI.ListMulticastGroupQueueRequest{
+		MulticastGroupId: id,
+	})
+	if err != nil {
+		return fmt.Errorf("grpc: can not list multicast queue: %v", err)
+	}
+	_, err = multicastService.Delete(context.Background(), &asAPI.DeleteMulticastGroupRequest{
+		Id: id,
+	})
+	if err != nil {
+		return fmt.Errorf("grpc: can not delete multicast group: %v", err)
+	}
+	// the queued downlinks are deleted with the group
+	items := make([]string, len(queue.Items))
+	for i, item := range queue.Items {
+		items[i] = multicastQueueItem(id, item.FCnt)
+	}
+	releaseDownlinkAirtime(items...)
+	return nil
+}
+
+// setMulticastKeys sets the address and session keys of a multicast group.
+func setMulticastKeys(id string, keys *MulticastKeys) error {
+	ctx := context.Background()
+
+	if err := keys.validate(); err != nil {
+		return err
+	}
+	conn, err := connectToChirpStack()
+	if err != nil {
+		return fmt.Errorf("grpc: can not connect to ChirpStack: %v", err)
+	}
+	defer conn.Close()
+
+	multicastService := asAPI.NewMulticastGroupServiceClient(conn)
+	resp, err := multicastService.Get(ctx, &asAPI.GetMulticastGroupRequest{
+		Id: id,
+	})
+	if err != nil {
+		return fmt.Errorf("grpc: can not get multicast group: %v", err)
+	}
+	mg := resp.MulticastGroup
+	mg.McAddr = keys.McAddr
+	mg.McNwkSKey = keys.McNwkSKey
+	mg.McAppSKey = keys.McAppSKey
+	_, err = multicastService.Update(ctx, &asAPI.UpdateMulticastGroupRequest{
+		MulticastGroup: mg,
+	})
+	if err != nil {
+		return fmt.Errorf("grpc: can not update multicast group: %v", err)
+	}
+	return nil
+}
+
+// setMulticastDevice adds a Wazigate device (or DevEUI) to a multicast group,
+// or removes it.
+func setMulticastDevice(id string, device string, add bool) error {
+	ctx := context.Background()
+
+	devEUI, err := multicastDevEUI(device)
+	if err != nil {
+		return err
+	}
+	conn, err := connectToChirpStack()
+	if err != nil {
+		return fmt.Errorf("grpc: can not connect to ChirpStack: %v", err)
+	}
+	defer conn.Close()
+
+	multicastService := asAPI.NewMulticastGroupServiceClient(conn)
+	if add {
+		_, err = multicastService.AddDevice(ctx, &asAPI.AddDeviceToMulticastGroupRequest{
+			MulticastGroupId: id,
+			DevEui:           devEUI,
+		})
+	} else {
+		_, err = multicastService.RemoveDevice(ctx, &asAPI.RemoveDeviceFromMulticastGroupRequest{
+			MulticastGroupId: id,
+			DevEui:           devEUI,
+		})
+	}
+	if err != nil {
+		return fmt.Errorf("grpc: can not change device %s of multicast group: %v", devEUI, err)
+	}
+	return nil
+}
+
+// enqueueMulticast adds a downlink to the queue of a multicast group and returns
+// its frame counter. Downlinks that exceed the duty-cycle budget are refused.
+func enqueueMulticast(id string, fPort uint32, data []byte) (uint32, error) {
+	if fPort < 1 || fPort > 223 {
+		return 0, fmt.Errorf("invalid fPort %d, must be 1..223", fPort)
+	}
+	conn, err := connectToChirpStack()
+	if err != nil {
+		return 0, fmt.Errorf("grpc: can not connect to ChirpStack: %v", err)
+	}
+	defer conn.Close()
+
+	multicastService := asAPI.NewMulticastGroupServiceClient(conn)
+	group, err := multicastService.Get(context.Background(), &asAPI.GetMulticastGroupRequest{
+		Id: id,
+	})
+	if err != nil {
+		return 0, fmt.Errorf("grpc: can not get multicast group: %v", err)
+	}
+	reservation, err := reserveAirtime(multicastChannel(group.MulticastGroup), len(data), multicastQueue(id))
+	if err != nil {
+		return 0, err
+	}
+	resp, err := multicastService.Enqueue(context.Background(), &asAPI.EnqueueMulticastGroupQueueItemRequest{
+		QueueItem: &asAPI.MulticastGroupQueueItem{
+			MulticastGroupId: id,
+			FPort:            fPort,
+			Data:             data,
+		},
+	})
+	if err != nil {
+		releaseDownlinkAirtime(reservation)
+		return 0, fmt.Errorf("grpc: can not enqueue multicast downlink: %v", err)
+	}
+	updateAirtime(reservation, multicastQueueItem(id, resp.FCnt))
+	return resp.FCnt, nil
+}
+
+// multicastQueue is the key of the queue of a multicast group in the airtime records.
+func multicastQueue(id string) string {
+	return "multicast/" + id
+}
+
+// multicastQueueItem is the key of a multicast downlink in the airtime records, as
+// multicast queue items are known by their frame counter.
+func multicastQueueItem(id string, fCnt uint32) string {
+	return fmt.Sprintf("multicast/%s/%d", id, fCnt)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// sendMulticastActuator sends an actuator value of a Wazigate "virtual device" to its
+// multicast group, set with the 'multicast' metadata of the device:
+//
+//	"multicast": {"group": "street-lights-zone-1", "fPort": 10}
+//
+// The actuator value is encoded with its 'encoding' template, otherwise the Wazigate
+// Edge marshals the device.
+func sendMulticastActuator(device *waziup.Device, actuatorID string) error {
+	multicast := device.Meta.Get("multicast")
+	group, err := multicast.Get("group").String()
+	if err != nil {
+		return fmt.Errorf("multicast: group: %v", err)
+	}
+	fPort := uint32(defaultDownlinkFPort)
+	if n, err := multicast.Get("fPort").Int(); err == nil {
+		fPort = uint32(n)
+	}
+	id, err := resolveMulticastGroup(group)
+	if err != nil {
+		return err
+	}
+	var actuator *waziup.Actuator
+	for _, a := range device.Actuators {
+		if a.ID == actuatorID {
+			actuator = a
+		}
+	}
+	var data []byte
+	if actuator != nil && !actuator.Meta.Get("encoding").Undefined() {
+		data, err = encodeActuator(actuator, actuator.Value, fPort)
+		if err != nil {
+			return fmt.Errorf("encoding of actuator %q: %v", actuatorID, err)
+		}
+	} else if data, err = wazigate.MarshalDevice(device.ID); err != nil {
+		return err
+	}
+	key := device.ID + "/" + actuatorID
+	return sendMulticast(key, nextSequence(key), id, fPort, data)
+}
+
+// sendMulticast enqueues a multicast downlink of a virtual device actuator. A downlink
+// deferred by the duty cycle is enqueued once the budget is available, unless a newer
+// value of the actuator has been sent meanwhile.
+func sendMulticast(key string, seq int, id string, fPort uint32, data []byte) error {
+	fCnt, err := enqueueMulticast(id, fPort, data)
+	if dcErr, ok := err.(*DutyCycleError); ok && dutyCyclePolicy() == DutyCycleDefer {
+		dcErr.Deferred = true
+		go func() {
+			time.Sleep(dcErr.Wait)
+			if !isSequence(key, seq) {
+				return
+			}
+			if err := sendMulticast(key, seq, id, fPort, data); err != nil {
+				log.Printf("Err Can not enqueue deferred multicast payload: %v", err)
+			}
+		}()
+	}
+	if err != nil {
+		return err
+	}
+	log.Printf("Multicast payload [%d] enqueued to group %q. FCnt %d", len(data), id, fCnt)
+	return nil
+}
@@ -0,0 +1,344 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Waziup/wazigate-lora/internal/pkg/wazigate"
+	"github.com/Waziup/wazigate-lora/internal/pkg/waziup"
+	asAPI "github.com/chirpstack/chirpstack/api/go/v4/api"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Kinds of drift between Wazigate and ChirpStack.
+const (
+	// DriftMissing is a Wazigate LoRaWAN device without ChirpStack device.
+	DriftMissing = "missing"
+	// DriftOrphaned is a ChirpStack device without Wazigate device.
+	DriftOrphaned = "orphaned"
+	// DriftProfileMismatch is a ChirpStack device with a different device profile
+	// than the Wazigate metadata asks for.
+	DriftProfileMismatch = "profile_mismatch"
+	// DriftKeyMismatch is a ChirpStack device with different OTAA keys or ABP
+	// session keys than the Wazigate metadata.
+	DriftKeyMismatch = "key_mismatch"
+)
+
+// Reconcile policies, set per drift kind in Config.Reconcile.Policy.
+const (
+	PolicyFix    = "fix"
+	PolicyReport = "report"
+)
+
+var defaultReconcilePolicy = map[string]string{
+	DriftMissing:         PolicyFix,
+	DriftOrphaned:        PolicyReport,
+	DriftProfileMismatch: PolicyFix,
+	DriftKeyMismatch:     PolicyFix,
+}
+
+const defaultReconcileInterval = 15 * time.Minute
+
+// reconcilePageSize is the number of ChirpStack devices listed per request.
+const reconcilePageSize = 500
+
+// Drift is a difference between a Wazigate device and its ChirpStack device.
+type Drift struct {
+	Kind        string `json:"kind"`
+	ID          string `json:"id,omitempty"`
+	DevEUI      string `json:"devEUI"`
+	Description string `json:"description"`
+	Fixed       bool   `json:"fixed"`
+	Error       string `json:"error,omitempty"`
+}
+
+// ReconcileReport is the result of one reconciliation run.
+type ReconcileReport struct {
+	Time   time.Time `json:"time"`
+	Drifts []Drift   `json:"drifts"`
+	Error  string    `json:"error,omitempty"`
+}
+
+// reconcileMutex serializes the reconciliation runs.
+var reconcileMutex sync.Mutex
+
+// lastReconcileReport has its own mutex, so it can be read during a run.
+var lastReconcileReport struct {
+	sync.Mutex
+	report *ReconcileReport
+}
+
+func reconcilePolicy(kind string) string {
+	if policy := Config.Reconcile.Policy[kind]; policy != "" {
+		return policy
+	}
+	return defaultReconcilePolicy[kind]
+}
+
+// RunReconciler reconciles Wazigate and ChirpStack devices periodically.
+func RunReconciler() {
+	interval := defaultReconcileInterval
+	if Config.Reconcile.Interval > 0 {
+		interval = time.Duration(Config.Reconcile.Interval) * time.Second
+	}
+	for {
+		time.Sleep(interval)
+		report := Reconcile()
+		if report.Error != "" {
+			log.Printf("Err Reconcile: %s", report.Error)
+		}
+	}
+}
+
+// LastReconcileReport returns the report of the last reconciliation, or nil.
+func LastReconcileReport() *ReconcileReport {
+	lastReconcileReport.Lock()
+	defer lastReconcileReport.Unlock()
+	return lastReconcileReport.report
+}
+
+// Reconcile compares the Wazigate LoRaWAN devices with the ChirpStack devices of the
+// application. Each drift is either fixed or just reported, depending on its policy.
+func Reconcile() *ReconcileReport {
+	reconcileMutex.Lock()
+	defer reconcileMutex.Unlock()
+
+	log.Println("--- Reconcile")
+
+	report := &ReconcileReport{
+		Time:   time.Now(),
+		Drifts: []Drift{},
+	}
+	if err := reconcile(report); err != nil {
+		report.Error = err.Error()
+	}
+	lastReconcileReport.Lock()
+	lastReconcileReport.report = report
+	lastReconcileReport.Unlock()
+	log.Printf("Reconcile: %d drifts found.", len(report.Drifts))
+	return report
+}
+
+func reconcile(report *ReconcileReport) error {
+	ctx := context.Background()
+
+	devices, err := wazigate.GetDevices(&waziup.DevicesQuery{
+		Meta: []string{"lorawan"},
+	})
+	if err != nil {
+		return fmt.Errorf("can not get LoRaWAN devices: %v", err)
+	}
+
+	conn, err := connectToChirpStack()
+	if err != nil {
+		return fmt.Errorf("grpc: can not connect to ChirpStack: %v", err)
+	}
+	defer conn.Close()
+
+	deviceClient := asAPI.NewDeviceServiceClient(conn)
+	csDevices := make(map[uint64]*asAPI.DeviceListItem)
+	for offset := uint32(0); ; {
+		resp, err := deviceClient.List(ctx, &asAPI.ListDevicesRequest{
+			Limit:         reconcilePageSize,
+			Offset:        offset,
+			ApplicationId: Config.Application.Id,
+		})
+		if err != nil {
+			return fmt.Errorf("grpc: can not list devices: %v", err)
+		}
+		for _, device := range resp.Result {
+			devEUI, err := strconv.ParseUint(device.DevEui, 16, 64)
+			if err != nil {
+				continue
+			}
+			csDevices[devEUI] = device
+		}
+		offset += uint32(len(resp.Result))
+		if len(resp.Result) == 0 || offset >= resp.TotalCount {
+			break
+		}
+	}
+
+	// device-profiles by the name and class used in the 'lorawan' metadata.
+	// Missing class profiles are not created here, only when a drift is fixed.
+	profiles := make(map[string]*asAPI.DeviceProfile)
+	resolve := func(lorawan waziup.JSON) (*asAPI.DeviceProfile, error) {
+		profile, err := lorawan.Get("profile").String()
+		if err != nil {
+			return nil, fmt.Errorf("profile: %v", err)
+		}
+		class, err := deviceClass(lorawan)
+		if err != nil {
+			return nil, err
+		}
+		key := fmt.Sprintf("%s/%s/%d", profile, class.Class, class.PingSlotPeriod)
+		if deviceProfile := profiles[key]; deviceProfile != nil {
+			return deviceProfile, nil
+		}
+		deviceProfile, err := resolveLoRaWANProfile(lorawan, false)
+		if err == nil {
+			profiles[key] = deviceProfile
+		}
+		return deviceProfile, err
+	}
+
+	linked := make(map[uint64]struct{}, len(devices))
+	for _, device := range devices {
+		lorawan := device.Meta.Get("lorawan")
+		if lorawan.Undefined() {
+			continue
+		}
+		devEUI, err := lorawan.Get("devEUI").String()
+		if err != nil {
+			continue
+		}
+		devEUIInt64, err := strconv.ParseUint(devEUI, 16, 64)
+		if err != nil {
+			continue
+		}
+		linked[devEUIInt64] = struct{}{}
+		devEUI = fmt.Sprintf("%016X", devEUIInt64)
+
+		// check returns the kind and description of the drift of the device, if any.
+		check := func(csDevice *asAPI.DeviceListItem) (string, string, error) {
+			if csDevice == nil {
+				return DriftMissing, "The device does not exist in ChirpStack.", nil
+			}
+			deviceProfile, err := resolve(lorawan)
+			if err != nil {
+				return DriftProfileMismatch, err.Error(), nil
+			}
+			if csDevice.DeviceProfileId != deviceProfile.Id {
+				return DriftProfileMismatch, fmt.Sprintf("The ChirpStack device uses device-profile %q instead of %q.", csDevice.DeviceProfileName, deviceProfile.Name), nil
+			}
+			desc, err := checkDeviceKeys(ctx, deviceClient, devEUI, lorawan, deviceProfile)
+			if desc != "" {
+				return DriftKeyMismatch, desc, err
+			}
+			return "", "", err
+		}
+
+		drift := Drift{
+			ID:     device.ID,
+			DevEUI: devEUI,
+		}
+		drift.Kind, drift.Description, err = check(csDevices[devEUIInt64])
+		if err != nil {
+			log.Printf("Err Reconcile device %q: %v", device.ID, err)
+			continue
+		}
+		if drift.Kind == "" {
+			continue
+		}
+		if reconcilePolicy(drift.Kind) == PolicyFix {
+			if err := checkWaziupDevice(device.ID, device.Meta); err != nil {
+				drift.Error = err.Error()
+			} else {
+				// checkWaziupDevice skips devices it can not provision, so the drift
+				// is only fixed if it is gone.
+				var csDevice *asAPI.DeviceListItem
+				r, err := deviceClient.Get(ctx, &asAPI.GetDeviceRequest{
+					DevEui: devEUI,
+				})
+				if err == nil {
+					csDevice = &asAPI.DeviceListItem{
+						DevEui:          r.Device.DevEui,
+						DeviceProfileId: r.Device.DeviceProfileId,
+					}
+				} else if status.Code(err) != codes.NotFound {
+					drift.Error = err.Error()
+				}
+				if drift.Error == "" {
+					if kind, desc, err := check(csDevice); err != nil {
+						drift.Error = err.Error()
+					} else if kind != "" {
+						drift.Error = "Not fixed: " + desc
+					} else {
+						drift.Fixed = true
+					}
+				}
+			}
+		}
+		report.Drifts = append(report.Drifts, drift)
+	}
+
+	for devEUIInt64, csDevice := range csDevices {
+		if _, ok := linked[devEUIInt64]; ok {
+			continue
+		}
+		drift := Drift{
+			Kind:        DriftOrphaned,
+			DevEUI:      fmt.Sprintf("%016X", devEUIInt64),
+			Description: fmt.Sprintf("The ChirpStack device %q has no Wazigate device.", csDevice.Name),
+		}
+		if Config.RemoveDevices == RemoveDevicesDisable {
+			r, err := deviceClient.Get(ctx, &asAPI.GetDeviceRequest{
+				DevEui: drift.DevEUI,
+			})
+			if err == nil && r.Device.IsDisabled {
+				continue
+			}
+		}
+		if reconcilePolicy(drift.Kind) == PolicyFix {
+			if err := removeChirpstackDevice(drift.DevEUI); err != nil {
+				drift.Error = err.Error()
+			} else {
+				drift.Fixed = true
+			}
+		}
+		report.Drifts = append(report.Drifts, drift)
+	}
+	return nil
+}
+
+// checkDeviceKeys compares the OTAA keys or ABP session keys of the 'lorawan' metadata
+// with the ChirpStack device. It returns a description of the difference, if any.
+func checkDeviceKeys(ctx context.Context, deviceClient asAPI.DeviceServiceClient, devEUI string, lorawan waziup.JSON, deviceProfile *asAPI.DeviceProfile) (string, error) {
+	if appKey, err := lorawan.Get("appKey").String(); err == nil {
+		nwkKey, _ := lorawan.Get("nwkKey").String()
+		if nwkKey == "" {
+			nwkKey, appKey = appKey, ""
+		}
+		r, err := deviceClient.GetKeys(ctx, &asAPI.GetDeviceKeysRequest{
+			DevEui: devEUI,
+		})
+		if status.Code(err) == codes.NotFound {
+			return "The ChirpStack device has no OTAA keys.", nil
+		}
+		if err != nil {
+			return "", err
+		}
+		if !strings.EqualFold(r.DeviceKeys.NwkKey, nwkKey) || !strings.EqualFold(r.DeviceKeys.AppKey, appKey) {
+			return "The ChirpStack device has different OTAA keys.", nil
+		}
+		return "", nil
+	}
+
+	if lorawan.Get("devAddr").Undefined() {
+		// not activated by personalization, nothing to compare
+		return "", nil
+	}
+	activation, err := readActivation(devEUI, lorawan, deviceProfile.MacVersion)
+	if err != nil {
+		return "", err
+	}
+	r, err := deviceClient.GetActivation(ctx, &asAPI.GetDeviceActivationRequest{
+		DevEui: devEUI,
+	})
+	if err != nil {
+		return "", err
+	}
+	if r.DeviceActivation == nil {
+		return "The ChirpStack device is not activated.", nil
+	}
+	if !sameSessionKeys(r.DeviceActivation, activation) {
+		return "The ChirpStack device has a different ABP activation.", nil
+	}
+	return "", nil
+}
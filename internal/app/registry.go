@@ -0,0 +1,370 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/Waziup/wazigate-lora/internal/pkg/waziapp"
+	"github.com/Waziup/wazigate-lora/internal/pkg/waziup"
+)
+
+// RegistryFile is the file in the WaziApp directory that persists the device registry.
+const RegistryFile = "devices.json"
+
+// RegistryEntry links a Wazigate device to a LoRaWAN device.
+type RegistryEntry struct {
+	// ID is the Wazigate device ID.
+	ID string `json:"id"`
+	// DevEUI is the LoRaWAN DevEUI (EUI64).
+	DevEUI uint64 `json:"-"`
+	// DevAddr is the LoRaWAN device address, if known (ABP or after a join).
+	DevAddr uint32 `json:"-"`
+	// FCnt are the frame counters last set from the 'lorawan' metadata.
+	FCnt frameCounters `json:"-"`
+	// LoRaWAN is the 'lorawan' metadata without the keys written by this service,
+	// and with hashes instead of the LoRaWAN keys.
+	LoRaWAN map[string]interface{} `json:"-"`
+	// Provisioned tells if the ChirpStack device has been set from this metadata.
+	Provisioned bool `json:"-"`
+}
+
+// Meta returns the 'lorawan' metadata of the device.
+func (entry RegistryEntry) Meta() waziup.JSON {
+	return waziup.NewJSON(entry.LoRaWAN)
+}
+
+// registryEntryJSON is the persisted form of a RegistryEntry with hex strings,
+// just like they appear in the 'lorawan' metadata.
+type registryEntryJSON struct {
+	ID       string  `json:"id"`
+	DevEUI   string  `json:"devEUI"`
+	DevAddr  string  `json:"devAddr,omitempty"`
+	FCntUp   *uint32 `json:"fCntUp,omitempty"`
+	FCntDown *uint32 `json:"fCntDown,omitempty"`
+
+	LoRaWAN     map[string]interface{} `json:"lorawan,omitempty"`
+	Provisioned bool                   `json:"provisioned,omitempty"`
+}
+
+func (entry RegistryEntry) MarshalJSON() ([]byte, error) {
+	e := registryEntryJSON{
+		ID:       entry.ID,
+		DevEUI:   fmt.Sprintf("%016X", entry.DevEUI),
+		FCntUp:   entry.FCnt.up,
+		FCntDown: entry.FCnt.down,
+		LoRaWAN:  entry.LoRaWAN,
+
+		Provisioned: entry.Provisioned,
+	}
+	if entry.DevAddr != 0 {
+		e.DevAddr = fmt.Sprintf("%08X", entry.DevAddr)
+	}
+	return json.Marshal(e)
+}
+
+func (entry *RegistryEntry) UnmarshalJSON(data []byte) (err error) {
+	var e registryEntryJSON
+	if err = json.Unmarshal(data, &e); err != nil {
+		return err
+	}
+	entry.ID = e.ID
+	entry.FCnt = frameCounters{e.FCntUp, e.FCntDown}
+	entry.LoRaWAN = e.LoRaWAN
+	entry.Provisioned = e.Provisioned
+	if entry.DevEUI, err = strconv.ParseUint(e.DevEUI, 16, 64); err != nil {
+		return fmt.Errorf("invalid devEUI %q", e.DevEUI)
+	}
+	entry.DevAddr = 0
+	if e.DevAddr != "" {
+		devAddr, err := strconv.ParseUint(e.DevAddr, 16, 32)
+		if err != nil {
+			return fmt.Errorf("invalid devAddr %q", e.DevAddr)
+		}
+		entry.DevAddr = uint32(devAddr)
+	}
+	return nil
+}
+
+// Registry is the set of Wazigate devices linked to LoRaWAN devices, indexed by
+// DevEUI, DevAddr and Wazigate ID. It is safe for concurrent use.
+type Registry struct {
+	mutex     sync.RWMutex
+	file      string
+	byDevEUI  map[uint64]*RegistryEntry
+	byDevAddr map[uint32]*RegistryEntry
+	byID      map[string]*RegistryEntry
+}
+
+var registry = newRegistry()
+
+func newRegistry() *Registry {
+	return &Registry{
+		byDevEUI:  make(map[uint64]*RegistryEntry),
+		byDevAddr: make(map[uint32]*RegistryEntry),
+		byID:      make(map[string]*RegistryEntry),
+	}
+}
+
+// LoadRegistry reads the persisted device registry from the WaziApp directory,
+// so that uplinks can be routed before the Wazigate Edge is reachable.
+func LoadRegistry() error {
+	return registry.load(filepath.Join(waziapp.Dir, RegistryFile))
+}
+
+func (r *Registry) load(file string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.file = file
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("can not open '%s': %v", RegistryFile, err)
+	}
+	var entries []RegistryEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return fmt.Errorf("can not parse '%s': %v", RegistryFile, err)
+	}
+	hashed := false
+	for i := range entries {
+		// files written by older versions have the LoRaWAN keys in clear text
+		config := lorawanConfig(waziup.NewJSON(entries[i].LoRaWAN))
+		if !reflect.DeepEqual(config, entries[i].LoRaWAN) {
+			entries[i].LoRaWAN = config
+			hashed = true
+		}
+		r.set(&entries[i])
+	}
+	if hashed {
+		r.save()
+	}
+	log.Printf("Registry: %d LoRaWAN devices loaded.", len(entries))
+	return nil
+}
+
+// save must be called with the mutex held.
+func (r *Registry) save() {
+	if r.file == "" {
+		return
+	}
+	data, _ := json.MarshalIndent(r.all(), "", "  ")
+	if err := writeFile(r.file, data); err != nil {
+		log.Printf("Err Can not write '%s': %v", RegistryFile, err)
+	}
+}
+
+// writeFile writes the data to a temporary file that only the owner can read, and
+// renames it to the file, so that the file is never left half written.
+func writeFile(file string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(file), filepath.Base(file)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
+
+// set must be called with the mutex held.
+func (r *Registry) set(entry *RegistryEntry) {
+	r.remove(entry.ID)
+	if old := r.byDevEUI[entry.DevEUI]; old != nil {
+		log.Printf("Err Registry: DevEUI %016X moved from device %q to device %q.", entry.DevEUI, old.ID, entry.ID)
+		r.remove(old.ID)
+	}
+	r.byID[entry.ID] = entry
+	r.byDevEUI[entry.DevEUI] = entry
+	if entry.DevAddr != 0 {
+		r.byDevAddr[entry.DevAddr] = entry
+	}
+}
+
+// remove must be called with the mutex held.
+func (r *Registry) remove(id string) (RegistryEntry, bool) {
+	entry := r.byID[id]
+	if entry == nil {
+		return RegistryEntry{}, false
+	}
+	delete(r.byID, id)
+	delete(r.byDevEUI, entry.DevEUI)
+	if r.byDevAddr[entry.DevAddr] == entry {
+		delete(r.byDevAddr, entry.DevAddr)
+	}
+	return *entry, true
+}
+
+// all must be called with the mutex held (read or write).
+func (r *Registry) all() []RegistryEntry {
+	entries := make([]RegistryEntry, 0, len(r.byID))
+	for _, entry := range r.byID {
+		entries = append(entries, *entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].ID < entries[j].ID
+	})
+	return entries
+}
+
+// Set links a Wazigate device to a DevEUI. An existing link of the same device is
+// replaced, but a DevEUI that is linked to another device is refused. The DevAddr is
+// kept if the DevEUI did not change.
+func (r *Registry) Set(id string, devEUI uint64, devAddr uint32, lorawan waziup.JSON) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if other := r.byDevEUI[devEUI]; other != nil && other.ID != id {
+		return fmt.Errorf("DevEUI %016X is already used by device %q", devEUI, other.ID)
+	}
+	config := lorawanConfig(lorawan)
+	var fCnt frameCounters
+	if old := r.byID[id]; old != nil && old.DevEUI == devEUI {
+		if devAddr == 0 {
+			devAddr = old.DevAddr
+		}
+		if old.DevAddr == devAddr && reflect.DeepEqual(old.LoRaWAN, config) {
+			return nil
+		}
+		fCnt = old.FCnt
+	}
+	r.set(&RegistryEntry{
+		ID:      id,
+		DevEUI:  devEUI,
+		DevAddr: devAddr,
+		FCnt:    fCnt,
+		LoRaWAN: config,
+	})
+	r.save()
+	return nil
+}
+
+// SetDevAddr updates the DevAddr of a linked device, e.g. after an OTAA join.
+func (r *Registry) SetDevAddr(devEUI uint64, devAddr uint32) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	entry := r.byDevEUI[devEUI]
+	if entry == nil {
+		return false
+	}
+	if entry.DevAddr == devAddr {
+		return true
+	}
+	r.set(&RegistryEntry{
+		ID:      entry.ID,
+		DevEUI:  devEUI,
+		DevAddr: devAddr,
+		FCnt:    entry.FCnt,
+		LoRaWAN: entry.LoRaWAN,
+
+		Provisioned: entry.Provisioned,
+	})
+	r.save()
+	return true
+}
+
+// SetProvisioned marks a linked device as provisioned in ChirpStack, until its
+// 'lorawan' metadata changes.
+func (r *Registry) SetProvisioned(id string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	entry := r.byID[id]
+	if entry == nil || entry.Provisioned {
+		return
+	}
+	entry.Provisioned = true
+	r.save()
+}
+
+// SetFrameCounters stores the frame counters last set from the 'lorawan' metadata.
+func (r *Registry) SetFrameCounters(id string, fCnt frameCounters) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	entry := r.byID[id]
+	if entry == nil || entry.FCnt.equal(fCnt) {
+		return
+	}
+	entry.FCnt = fCnt
+	r.save()
+}
+
+// Remove unlinks a Wazigate device and returns the removed entry.
+func (r *Registry) Remove(id string) (RegistryEntry, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	entry, ok := r.remove(id)
+	if ok {
+		r.save()
+	}
+	return entry, ok
+}
+
+// ByDevEUI returns the entry of a DevEUI.
+func (r *Registry) ByDevEUI(devEUI uint64) (RegistryEntry, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	entry := r.byDevEUI[devEUI]
+	if entry == nil {
+		return RegistryEntry{}, false
+	}
+	return *entry, true
+}
+
+// ByDevAddr returns the entry of a DevAddr.
+func (r *Registry) ByDevAddr(devAddr uint32) (RegistryEntry, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	entry := r.byDevAddr[devAddr]
+	if entry == nil {
+		return RegistryEntry{}, false
+	}
+	return *entry, true
+}
+
+// ByID returns the entry of a Wazigate device.
+func (r *Registry) ByID(id string) (RegistryEntry, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	entry := r.byID[id]
+	if entry == nil {
+		return RegistryEntry{}, false
+	}
+	return *entry, true
+}
+
+// All returns all entries, sorted by Wazigate ID.
+func (r *Registry) All() []RegistryEntry {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	return r.all()
+}
+
+// Len returns the number of linked devices.
+func (r *Registry) Len() int {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	return len(r.byID)
+}
@@ -0,0 +1,375 @@
+package app
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Waziup/wazigate-lora/internal/pkg/codec"
+	asAPI "github.com/chirpstack/chirpstack/api/go/v4/api"
+	asIntegr "github.com/chirpstack/chirpstack/api/go/v4/integration"
+)
+
+// postUplink forwards the payload of an uplink to the Wazigate device, following the
+// route of its fPort. If the route or the device has a codec, or else the device uses
+// the object decoded by the device-profile codec in ChirpStack, the decoded values are
+// posted as sensor (or actuator) values. Otherwise the raw payload is unmarshalled by
+// the Wazigate Edge.
+func postUplink(entry RegistryEntry, uplinkEvt *asIntegr.UplinkEvent) error {
+	route, err := portRoute(entry, uplinkEvt.FPort)
+	if err != nil {
+		return err
+	}
+	if route.Ignore {
+		log.Printf("Uplink on fPort %d ignored.", uplinkEvt.FPort)
+		return nil
+	}
+	var c codec.Codec
+	if route.Codec != nil {
+		if c, err = codec.New(route.Codec); err != nil {
+			return fmt.Errorf("codec of fPort %d: %v", uplinkEvt.FPort, err)
+		}
+	} else if c, err = deviceCodec(entry); err != nil {
+		return err
+	}
+	t := eventTime(uplinkEvt.Time)
+	var values map[string]interface{}
+	if c != nil {
+		values, err = c.Decode(uplinkEvt.FPort, uplinkEvt.Data)
+		if err != nil {
+			return fmt.Errorf("can not decode payload: %v", err)
+		}
+	} else if object := uplinkEvt.GetObject().AsMap(); len(object) != 0 && useDecodedObject(entry, uplinkEvt) {
+		values = object
+	} else {
+		return postOrQueue(&QueuedUplink{
+			Kind:     QueuedPayload,
+			DeviceID: entry.ID,
+			Data:     uplinkEvt.Data,
+			Time:     t,
+		})
+	}
+	return route.post(entry.ID, values, t)
+}
+
+// profileCodecCacheTime is how long the codec runtime of a device profile is cached.
+const profileCodecCacheTime = 5 * time.Minute
+
+type profileCodec struct {
+	runtime asAPI.CodecRuntime
+	time    time.Time
+}
+
+// profileCodecs caches the codec runtime of the device profiles by ID.
+var profileCodecs = struct {
+	sync.Mutex
+	runtimes map[string]profileCodec
+}{runtimes: make(map[string]profileCodec)}
+
+// useDecodedObject tells if the object decoded by the device-profile codec is posted
+// instead of the raw payload. The 'object' option of the 'lorawan' metadata decides,
+// otherwise the object is used unless the profile codec is the built-in Cayenne LPP,
+// whose nested objects the Wazigate Edge already parses from the raw payload.
+func useDecodedObject(entry RegistryEntry, uplinkEvt *asIntegr.UplinkEvent) bool {
+	if object, err := entry.Meta().Get("object").Bool(); err == nil {
+		return object
+	}
+	profileID := uplinkEvt.GetDeviceInfo().GetDeviceProfileId()
+	if profileID == "" {
+		return false
+	}
+
+	profileCodecs.Lock()
+	cached, ok := profileCodecs.runtimes[profileID]
+	profileCodecs.Unlock()
+	if !ok || time.Since(cached.time) > profileCodecCacheTime {
+		deviceProfile, err := getDeviceProfile(profileID)
+		if err != nil {
+			log.Printf("Err Device %q: %v", entry.ID, err)
+			return false
+		}
+		cached = profileCodec{deviceProfile.PayloadCodecRuntime, time.Now()}
+		profileCodecs.Lock()
+		profileCodecs.runtimes[profileID] = cached
+		profileCodecs.Unlock()
+	}
+	return cached.runtime != asAPI.CodecRuntime_CAYENNE_LPP
+}
+
+// deviceCodec returns the codec of the 'codec' key of the 'lorawan' metadata, or the
+// JavaScript codec file of the device profile ('codecs/<profile>.js'), or nil.
+func deviceCodec(entry RegistryEntry) (codec.Codec, error) {
+	spec := entry.Meta().Get("codec").Value()
+	if spec == nil {
+		profile, _ := entry.Meta().Get("profile").String()
+		if profile == "" {
+			return nil, nil
+		}
+		file := filepath.Base(profile) + ".js"
+		if _, err := os.Stat(filepath.Join(codec.ScriptDir, file)); err != nil {
+			return nil, nil
+		}
+		spec = map[string]interface{}{"type": "js", "file": file}
+	}
+	c, err := codec.New(spec)
+	if err != nil {
+		return nil, fmt.Errorf("codec: %v", err)
+	}
+	return c, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// RouteIgnore is the route of fPorts whose uplinks are dropped.
+const RouteIgnore = "ignore"
+
+// uplinkRoute is the route of an fPort in the 'ports' of the 'lorawan' metadata.
+type uplinkRoute struct {
+	// Ignore drops the uplinks.
+	Ignore bool
+	// Codec replaces the codec of the device.
+	Codec interface{}
+	// Sensors and Actuators map the decoded value names to sensor and actuator IDs.
+	// Without both, all values are posted to the sensors with the same IDs.
+	Sensors   map[string]string
+	Actuators map[string]string
+}
+
+// portRoute returns the route of an fPort: the 'ports' entry of the fPort, or else
+// the "*" entry. Without both, the uplink takes the default route.
+func portRoute(entry RegistryEntry, fPort uint32) (*uplinkRoute, error) {
+	ports := entry.Meta().Get("ports")
+	route := ports.Get(strconv.FormatUint(uint64(fPort), 10))
+	if route.Undefined() {
+		route = ports.Get("*")
+	}
+	switch value := route.Value().(type) {
+	case nil:
+		return &uplinkRoute{}, nil
+	case string:
+		if value == RouteIgnore {
+			return &uplinkRoute{Ignore: true}, nil
+		}
+	case map[string]interface{}:
+		var err error
+		r := &uplinkRoute{Codec: value["codec"]}
+		if r.Sensors, err = routeTargets(value["sensors"]); err != nil {
+			return nil, fmt.Errorf("ports: fPort %d: sensors: %v", fPort, err)
+		}
+		if r.Actuators, err = routeTargets(value["actuators"]); err != nil {
+			return nil, fmt.Errorf("ports: fPort %d: actuators: %v", fPort, err)
+		}
+		return r, nil
+	}
+	return nil, fmt.Errorf("ports: fPort %d: invalid route %v", fPort, route.Value())
+}
+
+// routeTargets reads a list of value names or an object of value names to IDs.
+func routeTargets(value interface{}) (map[string]string, error) {
+	switch value := value.(type) {
+	case nil:
+		return nil, nil
+	case []interface{}:
+		targets := make(map[string]string, len(value))
+		for _, name := range value {
+			s, ok := name.(string)
+			if !ok {
+				return nil, fmt.Errorf("%v is not a string", name)
+			}
+			targets[s] = s
+		}
+		return targets, nil
+	case map[string]interface{}:
+		targets := make(map[string]string, len(value))
+		for name, id := range value {
+			s, ok := id.(string)
+			if !ok {
+				return nil, fmt.Errorf("%v is not a string", id)
+			}
+			targets[name] = s
+		}
+		return targets, nil
+	default:
+		return nil, fmt.Errorf("%v is neither a list nor an object", value)
+	}
+}
+
+// post posts the decoded values to the sensors and actuators of the route.
+// Values that are not part of the route are dropped.
+func (route *uplinkRoute) post(devID string, values map[string]interface{}, t time.Time) error {
+	if route.Sensors == nil && route.Actuators == nil {
+		return postSensorValues(devID, values, t)
+	}
+	sensorValues := make(map[string]interface{}, len(route.Sensors))
+	for name, sensorID := range route.Sensors {
+		if value, ok := values[name]; ok {
+			sensorValues[sensorID] = value
+		}
+	}
+	if err := postSensorValues(devID, sensorValues, t); err != nil {
+		return err
+	}
+	actuatorValues := make(map[string]interface{}, len(route.Actuators))
+	for name, actuatorID := range route.Actuators {
+		if value, ok := values[name]; ok {
+			actuatorValues[actuatorID] = value
+		}
+	}
+	return postActuatorValues(devID, actuatorValues, t)
+}
+
+// postSensorValues posts each value to the sensor with the same ID, in the order of
+// the sensor IDs. Nested objects are posted as they are, as one sensor value.
+func postSensorValues(devID string, values map[string]interface{}, t time.Time) error {
+	sensorIDs := make([]string, 0, len(values))
+	for sensorID := range values {
+		sensorIDs = append(sensorIDs, sensorID)
+	}
+	sort.Strings(sensorIDs)
+	for _, sensorID := range sensorIDs {
+		if err := postSensorValue(devID, sensorID, values[sensorID], t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// postSensorValue posts a sensor value and creates the sensor if it does not exist.
+// If the Wazigate Edge is unreachable, the value is queued.
+func postSensorValue(devID string, sensorID string, value interface{}, t time.Time) error {
+	return postOrQueue(&QueuedUplink{
+		Kind:     QueuedSensorValue,
+		DeviceID: devID,
+		TargetID: sensorID,
+		Value:    value,
+		Time:     t,
+	})
+}
+
+// reportedActuators holds the actuator values posted from uplinks, so that they are
+// not sent back to the device as downlinks.
+var reportedActuators = struct {
+	sync.Mutex
+	values map[string]time.Time
+}{values: make(map[string]time.Time)}
+
+// isReportedActuator tells if the last value of an actuator was posted from an uplink.
+func isReportedActuator(devID string, actuatorID string) bool {
+	reportedActuators.Lock()
+	defer reportedActuators.Unlock()
+
+	key := devID + "/" + actuatorID
+	t, ok := reportedActuators.values[key]
+	delete(reportedActuators.values, key)
+	return ok && time.Since(t) < 30*time.Second
+}
+
+// postActuatorValues posts each value to the actuator with the same ID, in the order
+// of the actuator IDs.
+func postActuatorValues(devID string, values map[string]interface{}, t time.Time) error {
+	actuatorIDs := make([]string, 0, len(values))
+	for actuatorID := range values {
+		actuatorIDs = append(actuatorIDs, actuatorID)
+	}
+	sort.Strings(actuatorIDs)
+	for _, actuatorID := range actuatorIDs {
+		if err := postActuatorValue(devID, actuatorID, values[actuatorID], t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// postActuatorValue posts an actuator value reported by the device and creates the
+// actuator if it does not exist. If the Wazigate Edge is unreachable, the value is queued.
+func postActuatorValue(devID string, actuatorID string, value interface{}, t time.Time) error {
+	return postOrQueue(&QueuedUplink{
+		Kind:     QueuedActuatorValue,
+		DeviceID: devID,
+		TargetID: actuatorID,
+		Value:    value,
+		Time:     t,
+	})
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Modes of the 'linkQuality' option in the 'lorawan' metadata.
+const (
+	// LinkQualitySensors posts the link quality as values of the 'lora_*' sensors.
+	LinkQualitySensors = "sensors"
+	// LinkQualityMeta writes the link quality to the 'lorawan.link' metadata.
+	LinkQualityMeta = "meta"
+)
+
+// LinkQuality describes the radio reception of an uplink.
+type LinkQuality struct {
+	RSSI            int32     `json:"rssi"`
+	SNR             float32   `json:"snr"`
+	SpreadingFactor uint32    `json:"sf,omitempty"`
+	Frequency       uint32    `json:"frequency"`
+	FCnt            uint32    `json:"fCnt"`
+	Gateway         string    `json:"gateway"`
+	Time            time.Time `json:"time"`
+}
+
+// newLinkQuality returns the link quality of an uplink, using the reception of
+// the gateway with the best RSSI.
+func newLinkQuality(uplinkEvt *asIntegr.UplinkEvent) *LinkQuality {
+	if len(uplinkEvt.RxInfo) == 0 {
+		return nil
+	}
+	best := uplinkEvt.RxInfo[0]
+	for _, rxInfo := range uplinkEvt.RxInfo[1:] {
+		if rxInfo.Rssi > best.Rssi {
+			best = rxInfo
+		}
+	}
+	link := &LinkQuality{
+		RSSI:    best.Rssi,
+		SNR:     best.Snr,
+		FCnt:    uplinkEvt.FCnt,
+		Gateway: best.GatewayId,
+		Time:    eventTime(uplinkEvt.Time),
+	}
+	if txInfo := uplinkEvt.TxInfo; txInfo != nil {
+		link.Frequency = txInfo.Frequency
+		if lora := txInfo.GetModulation().GetLora(); lora != nil {
+			link.SpreadingFactor = lora.SpreadingFactor
+		}
+	}
+	return link
+}
+
+// postLinkQuality publishes the link quality of an uplink to the Wazigate device,
+// if the device opted in with the 'linkQuality' option of its 'lorawan' metadata.
+func postLinkQuality(entry RegistryEntry, uplinkEvt *asIntegr.UplinkEvent) error {
+	mode, _ := entry.Meta().Get("linkQuality").String()
+	if mode == "" {
+		return nil
+	}
+	link := newLinkQuality(uplinkEvt)
+	if link == nil {
+		return nil
+	}
+	switch mode {
+	case LinkQualitySensors:
+		return postSensorValues(entry.ID, map[string]interface{}{
+			"lora_rssi":      link.RSSI,
+			"lora_snr":       link.SNR,
+			"lora_sf":        link.SpreadingFactor,
+			"lora_frequency": link.Frequency,
+			"lora_fcnt":      link.FCnt,
+			"lora_gateway":   link.Gateway,
+		}, link.Time)
+	case LinkQualityMeta:
+		return setLoRaWANMeta(entry.ID, "link", link)
+	default:
+		return fmt.Errorf("unknown linkQuality %q", mode)
+	}
+}
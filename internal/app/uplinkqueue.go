@@ -0,0 +1,372 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/Waziup/wazigate-lora/internal/pkg/waziapp"
+	"github.com/Waziup/wazigate-lora/internal/pkg/wazigate"
+	"github.com/Waziup/wazigate-lora/internal/pkg/waziup"
+)
+
+// UplinkQueueFile is the file in the WaziApp directory that persists the uplink queue.
+const UplinkQueueFile = "uplinks.json"
+
+const defaultUplinkQueueSize = 10000
+
+const (
+	minUplinkBackoff = time.Second
+	maxUplinkBackoff = 5 * time.Minute
+	// maxUplinkAttempts is the number of attempts of an uplink that the Wazigate Edge
+	// refuses with a server error. Attempts while the edge is offline are not counted.
+	maxUplinkAttempts = 10
+)
+
+// Kinds of queued uplink posts.
+const (
+	QueuedSensorValue   = "sensor"
+	QueuedActuatorValue = "actuator"
+	QueuedPayload       = "payload"
+)
+
+// QueuedUplink is an uplink post to the Wazigate Edge that is replayed when the edge
+// is reachable again.
+type QueuedUplink struct {
+	ID       uint64 `json:"id"`
+	Kind     string `json:"kind"`
+	DeviceID string `json:"deviceId"`
+	// TargetID is the sensor or actuator ID.
+	TargetID string      `json:"targetId,omitempty"`
+	Value    interface{} `json:"value,omitempty"`
+	// Data is the raw payload, unmarshalled by the Wazigate Edge.
+	Data []byte `json:"data,omitempty"`
+	// Time the uplink has been received.
+	Time time.Time `json:"time"`
+	// Attempts is the number of failed attempts with a server error.
+	Attempts int `json:"attempts,omitempty"`
+}
+
+// UplinkQueueStatus is the state of the uplink queue.
+type UplinkQueueStatus struct {
+	Length int `json:"length"`
+	Size   int `json:"size"`
+	// Dropped is the number of uplinks dropped because the queue was full.
+	Dropped     int             `json:"dropped"`
+	LastError   string          `json:"lastError,omitempty"`
+	NextAttempt *time.Time      `json:"nextAttempt,omitempty"`
+	Items       []*QueuedUplink `json:"items"`
+}
+
+// UplinkQueue holds the uplink posts that failed because the Wazigate Edge was not
+// reachable, in the order they have been received. It is safe for concurrent use.
+type UplinkQueue struct {
+	mutex       sync.Mutex
+	file        string
+	items       []*QueuedUplink
+	nextID      uint64
+	unsaved     int
+	saved       time.Time
+	dropped     int
+	lastError   string
+	nextAttempt time.Time
+	wake        chan struct{}
+}
+
+var uplinkQueue = &UplinkQueue{
+	wake: make(chan struct{}, 1),
+}
+
+func uplinkQueueSize() int {
+	if Config.UplinkQueue.Size > 0 {
+		return Config.UplinkQueue.Size
+	}
+	return defaultUplinkQueueSize
+}
+
+// LoadUplinkQueue reads the persisted uplink queue from the WaziApp directory.
+func LoadUplinkQueue() error {
+	return uplinkQueue.load(filepath.Join(waziapp.Dir, UplinkQueueFile))
+}
+
+func (q *UplinkQueue) load(file string) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.file = file
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("can not open '%s': %v", UplinkQueueFile, err)
+	}
+	if err := json.Unmarshal(data, &q.items); err != nil {
+		return fmt.Errorf("can not parse '%s': %v", UplinkQueueFile, err)
+	}
+	for _, item := range q.items {
+		if item.ID >= q.nextID {
+			q.nextID = item.ID + 1
+		}
+	}
+	log.Printf("Uplink queue: %d uplinks loaded.", len(q.items))
+	return nil
+}
+
+// save must be called with the mutex held.
+func (q *UplinkQueue) save() {
+	q.unsaved = 0
+	q.saved = time.Now()
+	if q.file == "" {
+		return
+	}
+	data, _ := json.Marshal(q.items)
+	if err := writeFile(q.file, data); err != nil {
+		log.Printf("Err Can not write '%s': %v", UplinkQueueFile, err)
+	}
+}
+
+// Push appends an uplink to the queue. If the queue is full, the oldest uplink is dropped.
+// The queue file is written after every 100 uplinks, or 10 seconds after the last write,
+// and when an attempt to replay the queue fails.
+func (q *UplinkQueue) Push(item *QueuedUplink) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	item.ID = q.nextID
+	q.nextID++
+	if size := uplinkQueueSize(); len(q.items) >= size {
+		n := len(q.items) - size + 1
+		log.Printf("Err Uplink queue is full, dropping %d uplinks.", n)
+		q.items = q.items[n:]
+		q.dropped += n
+	}
+	q.items = append(q.items, item)
+	if q.unsaved++; q.unsaved >= 100 || time.Since(q.saved) >= 10*time.Second {
+		q.save()
+	}
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Peek returns the oldest uplink, or nil.
+func (q *UplinkQueue) Peek() *QueuedUplink {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if len(q.items) == 0 {
+		return nil
+	}
+	return q.items[0]
+}
+
+// Pop removes an uplink from the head of the queue. The queue file is written
+// after every 100 uplinks, so a crash might replay some uplinks twice.
+func (q *UplinkQueue) Pop(id uint64) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if len(q.items) == 0 || q.items[0].ID != id {
+		return
+	}
+	q.items[0] = nil
+	q.items = q.items[1:]
+	q.lastError = ""
+	q.nextAttempt = time.Time{}
+	if q.unsaved++; q.unsaved >= 100 || len(q.items) == 0 {
+		q.save()
+	}
+}
+
+// Len returns the number of queued uplinks.
+func (q *UplinkQueue) Len() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	return len(q.items)
+}
+
+// Clear removes all uplinks and returns their number.
+func (q *UplinkQueue) Clear() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	n := len(q.items)
+	q.items = nil
+	q.save()
+	return n
+}
+
+// Status returns the state of the queue with up to limit of the oldest uplinks.
+func (q *UplinkQueue) Status(limit int) *UplinkQueueStatus {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if limit > len(q.items) {
+		limit = len(q.items)
+	}
+	status := &UplinkQueueStatus{
+		Length:    len(q.items),
+		Size:      uplinkQueueSize(),
+		Dropped:   q.dropped,
+		LastError: q.lastError,
+		Items:     make([]*QueuedUplink, limit),
+	}
+	// copies, as the items change while the status is encoded
+	for i, item := range q.items[:limit] {
+		c := *item
+		status.Items[i] = &c
+	}
+	if !q.nextAttempt.IsZero() {
+		nextAttempt := q.nextAttempt
+		status.NextAttempt = &nextAttempt
+	}
+	return status
+}
+
+func (q *UplinkQueue) failed(err error, nextAttempt time.Time) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.lastError = err.Error()
+	q.nextAttempt = nextAttempt
+	if q.unsaved != 0 {
+		q.save()
+	}
+}
+
+// attempt counts a failed attempt of an uplink and returns the number of attempts.
+func (q *UplinkQueue) attempt(item *QueuedUplink) int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	item.Attempts++
+	return item.Attempts
+}
+
+// RunUplinkQueue replays the queued uplinks in order. While the Wazigate Edge is
+// unreachable, the attempts are repeated with an exponential backoff. Uplinks that
+// the edge keeps refusing with a server error are dropped after maxUplinkAttempts.
+func RunUplinkQueue() {
+	backoff := minUplinkBackoff
+	for {
+		item := uplinkQueue.Peek()
+		if item == nil {
+			<-uplinkQueue.wake
+			continue
+		}
+		err := item.post(true)
+		if waziup.IsUnreachable(err) && !waziup.IsOffline(err) {
+			if n := uplinkQueue.attempt(item); n >= maxUplinkAttempts {
+				err = fmt.Errorf("%d attempts failed: %w", n, err)
+				log.Printf("Err Uplink queue: dropping uplink %d of device %q: %v", item.ID, item.DeviceID, err)
+				backoff = minUplinkBackoff
+				uplinkQueue.Pop(item.ID)
+				continue
+			}
+		}
+		if waziup.IsUnreachable(err) {
+			log.Printf("Err Uplink queue: %d uplinks waiting, retry in %v: %v", uplinkQueue.Len(), backoff, err)
+			uplinkQueue.failed(err, time.Now().Add(backoff))
+			time.Sleep(backoff)
+			if backoff *= 2; backoff > maxUplinkBackoff {
+				backoff = maxUplinkBackoff
+			}
+			continue
+		}
+		backoff = minUplinkBackoff
+		if err != nil {
+			log.Printf("Err Uplink queue: dropping uplink %d of device %q: %v", item.ID, item.DeviceID, err)
+		}
+		uplinkQueue.Pop(item.ID)
+	}
+}
+
+// postOrQueue posts the uplink right away, unless older uplinks are queued or the
+// Wazigate Edge is unreachable. Then the uplink is queued and replayed later.
+func postOrQueue(item *QueuedUplink) error {
+	if uplinkQueue.Len() == 0 {
+		err := item.post(false)
+		if !waziup.IsUnreachable(err) {
+			return err
+		}
+		log.Printf("Err Wazigate Edge unreachable, queuing the uplink: %v", err)
+	}
+	uplinkQueue.Push(item)
+	return nil
+}
+
+// post sends the uplink to the Wazigate Edge, creating missing sensors and actuators.
+// Replayed values are posted with the time the uplink has been received. Raw payloads
+// are unmarshalled by the edge like live ones, so they keep their sensors but the edge
+// gives them the time of the replay.
+func (item *QueuedUplink) post(replay bool) error {
+	devID := item.DeviceID
+	switch item.Kind {
+	case QueuedSensorValue:
+		add := func() error {
+			if replay {
+				return wazigate.AddSensorValues(devID, item.TargetID, []waziup.Value{{Value: item.Value, Time: item.Time}})
+			}
+			return wazigate.AddSensorValue(devID, item.TargetID, item.Value)
+		}
+		err := add()
+		if waziup.IsNotExist(err) {
+			log.Printf("Creating sensor %q of device %q.", item.TargetID, devID)
+			sensor := &waziup.Sensor{
+				ID:   item.TargetID,
+				Name: item.TargetID,
+			}
+			if err := wazigate.AddSensor(devID, sensor); err != nil {
+				return fmt.Errorf("can not create sensor %q: %w", item.TargetID, err)
+			}
+			err = add()
+		}
+		if err != nil {
+			return fmt.Errorf("can not post value of sensor %q: %w", item.TargetID, err)
+		}
+		return nil
+
+	case QueuedActuatorValue:
+		reportedActuators.Lock()
+		reportedActuators.values[devID+"/"+item.TargetID] = time.Now()
+		reportedActuators.Unlock()
+
+		add := func() error {
+			if replay {
+				return wazigate.AddActuatorValues(devID, item.TargetID, []waziup.Value{{Value: item.Value, Time: item.Time}})
+			}
+			return wazigate.AddActuatorValue(devID, item.TargetID, item.Value)
+		}
+		err := add()
+		if waziup.IsNotExist(err) {
+			log.Printf("Creating actuator %q of device %q.", item.TargetID, devID)
+			actuator := &waziup.Actuator{
+				ID:   item.TargetID,
+				Name: item.TargetID,
+			}
+			if err := wazigate.AddActuator(devID, actuator); err != nil {
+				return fmt.Errorf("can not create actuator %q: %w", item.TargetID, err)
+			}
+			err = add()
+		}
+		if err != nil {
+			return fmt.Errorf("can not post value of actuator %q: %w", item.TargetID, err)
+		}
+		return nil
+
+	case QueuedPayload:
+		return wazigate.UnmarshalDevice(devID, item.Data)
+
+	default:
+		return fmt.Errorf("unknown kind %q", item.Kind)
+	}
+}
@@ -0,0 +1,141 @@
+// Package codec converts LoRaWAN payloads to named values and back.
+//
+// A codec is chosen per device with the 'codec' key of the 'lorawan' metadata,
+// either by name or as an object with a "type" and the codec options:
+//
+//	"codec": "cayenne"
+//	"codec": {"type": "layout", "fields": [{"name": "temperature", "type": "int16", "scale": 0.1}]}
+//	"codec": {"type": "js", "file": "lht65.js"}
+package codec
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Codec decodes uplink payloads and encodes downlink payloads.
+type Codec interface {
+	// Decode returns the named values of an uplink payload received on fPort.
+	Decode(fPort uint32, data []byte) (map[string]interface{}, error)
+	// Encode returns the downlink payload for fPort with the named values.
+	Encode(fPort uint32, values map[string]interface{}) ([]byte, error)
+}
+
+// New returns the codec of a 'codec' metadata value: a codec name or an object
+// with the codec "type" and its options.
+func New(spec interface{}) (Codec, error) {
+	switch spec := spec.(type) {
+	case string:
+		return newCodec(spec, nil)
+	case map[string]interface{}:
+		typ, _ := spec["type"].(string)
+		if typ == "" {
+			return nil, errors.New("the codec has no type")
+		}
+		options, err := json.Marshal(spec)
+		if err != nil {
+			return nil, err
+		}
+		return newCodec(typ, options)
+	default:
+		return nil, fmt.Errorf("invalid codec %v", spec)
+	}
+}
+
+func newCodec(typ string, options []byte) (Codec, error) {
+	switch strings.ToLower(typ) {
+	case "cayenne", "cayennelpp", "lpp":
+		return CayenneLPP, nil
+	case "xlpp":
+		return XLPP, nil
+	case "layout":
+		return newLayout(options)
+	case "js", "javascript":
+		return newJSCodec(options)
+	default:
+		return nil, fmt.Errorf("unknown codec %q", typ)
+	}
+}
+
+// toFloat converts a (JSON) value to a number.
+func toFloat(value interface{}) (float64, error) {
+	switch v := value.(type) {
+	case float64:
+		return v, nil
+	case float32:
+		return float64(v), nil
+	case int:
+		return float64(v), nil
+	case int32:
+		return float64(v), nil
+	case int64:
+		return float64(v), nil
+	case uint32:
+		return float64(v), nil
+	case uint64:
+		return float64(v), nil
+	case bool:
+		if v {
+			return 1, nil
+		}
+		return 0, nil
+	case json.Number:
+		return v.Float64()
+	case string:
+		return strconv.ParseFloat(v, 64)
+	default:
+		return 0, fmt.Errorf("%v is not a number", value)
+	}
+}
+
+// readUint reads a big-endian unsigned integer.
+func readUint(data []byte) (n uint64) {
+	for _, b := range data {
+		n = n<<8 | uint64(b)
+	}
+	return n
+}
+
+// readInt reads a big-endian two's complement integer.
+func readInt(data []byte) int64 {
+	shift := 64 - 8*uint(len(data))
+	return int64(readUint(data)<<shift) >> shift
+}
+
+// writeInt writes a big-endian integer with the size of data bytes.
+func writeInt(data []byte, n int64) {
+	for i := len(data) - 1; i >= 0; i-- {
+		data[i] = byte(n)
+		n >>= 8
+	}
+}
+
+// scale returns n * resolution, rounded to 9 decimals to avoid values like
+// 21.900000000000002.
+func scale(n float64, resolution float64) float64 {
+	if resolution == 1 {
+		return n
+	}
+	return math.Round(n*resolution*1e9) / 1e9
+}
+
+// scaleInt converts a value to an integer of size bytes with the given resolution.
+func scaleInt(value interface{}, size int, scale float64, signed bool) (int64, error) {
+	f, err := toFloat(value)
+	if err != nil {
+		return 0, err
+	}
+	n := math.Round(f / scale)
+	min, max := 0.0, math.Exp2(float64(8*size))
+	if signed {
+		min, max = -max/2, max/2
+	}
+	if n < min || n >= max {
+		return 0, fmt.Errorf("%v is out of range", value)
+	}
+	return int64(n), nil
+}
@@ -0,0 +1,289 @@
+package codec
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"runtime/metrics"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dop251/goja"
+)
+
+// ScriptDir is the directory of the JavaScript codec files.
+var ScriptDir = "codecs"
+
+// Default limits of a JavaScript codec run.
+const (
+	DefaultJSTimeout   = 100 * time.Millisecond
+	DefaultJSMaxMemory = 16 << 20
+)
+
+// JS is a JavaScript codec, compatible with The Things Network and ChirpStack codecs:
+//
+//	function decodeUplink(input) { // input: {bytes, fPort, recvTime}
+//	  return {data: {temperature: 21.5}, warnings: [], errors: []};
+//	}
+//	function encodeDownlink(input) { // input: {data, fPort}
+//	  return {bytes: [1, 2], fPort: 2, warnings: [], errors: []};
+//	}
+//
+// ChirpStack v3 codecs with 'Decode(fPort, bytes)' and 'Encode(fPort, obj)' work as well.
+// Each run is sandboxed in a new JavaScript runtime without access to the host, and
+// interrupted if it takes longer than the Timeout or allocates more than MaxMemory.
+type JS struct {
+	program *goja.Program
+	// Timeout of each run.
+	Timeout time.Duration
+	// MaxMemory is the approximate number of bytes a run may allocate on the heap.
+	// Goja can not measure the allocations of a runtime, so the allocations of the
+	// whole process during the run are counted: concurrent runs and other work may
+	// interrupt a run early, and a run may exceed it between two samples.
+	MaxMemory uint64
+}
+
+type jsOptions struct {
+	Script    string `json:"script"`
+	File      string `json:"file"`
+	Timeout   int    `json:"timeout"`   // milliseconds
+	MaxMemory uint64 `json:"maxMemory"` // bytes
+}
+
+// jsPrograms caches the compiled scripts by their SHA256 checksum.
+var jsPrograms sync.Map
+
+func newJSCodec(options []byte) (*JS, error) {
+	var opts jsOptions
+	if err := json.Unmarshal(options, &opts); err != nil {
+		return nil, fmt.Errorf("js: %v", err)
+	}
+	if opts.File != "" {
+		if opts.Script != "" {
+			return nil, errors.New("js: either 'script' or 'file' must be set, not both")
+		}
+		script, err := ReadScript(opts.File)
+		if err != nil {
+			return nil, err
+		}
+		opts.Script = script
+	}
+	js, err := NewJS(opts.Script)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Timeout > 0 {
+		js.Timeout = time.Duration(opts.Timeout) * time.Millisecond
+	}
+	if opts.MaxMemory > 0 {
+		js.MaxMemory = opts.MaxMemory
+	}
+	return js, nil
+}
+
+// ReadScript reads a JavaScript codec file from the ScriptDir.
+func ReadScript(name string) (string, error) {
+	name = filepath.Base(name)
+	if !strings.HasSuffix(name, ".js") {
+		name += ".js"
+	}
+	data, err := ioutil.ReadFile(filepath.Join(ScriptDir, name))
+	if err != nil {
+		return "", fmt.Errorf("js: %v", err)
+	}
+	return string(data), nil
+}
+
+// NewJS compiles a JavaScript codec with the default limits.
+func NewJS(script string) (*JS, error) {
+	if strings.TrimSpace(script) == "" {
+		return nil, errors.New("js: no script")
+	}
+	sum := sha256.Sum256([]byte(script))
+	program, ok := jsPrograms.Load(sum)
+	if !ok {
+		p, err := goja.Compile("codec.js", script, false)
+		if err != nil {
+			return nil, fmt.Errorf("js: %v", err)
+		}
+		program, _ = jsPrograms.LoadOrStore(sum, p)
+	}
+	return &JS{
+		program:   program.(*goja.Program),
+		Timeout:   DefaultJSTimeout,
+		MaxMemory: DefaultJSMaxMemory,
+	}, nil
+}
+
+// run calls the first of the functions defined by the script.
+func (js *JS) run(args func(vm *goja.Runtime, name string) []goja.Value, names ...string) (goja.Value, error) {
+	vm := goja.New()
+	vm.SetMaxCallStackSize(256)
+
+	done := make(chan struct{})
+	defer close(done)
+	go js.watch(vm, done)
+
+	if _, err := vm.RunProgram(js.program); err != nil {
+		return nil, jsError(err)
+	}
+	for _, name := range names {
+		if fn, ok := goja.AssertFunction(vm.Get(name)); ok {
+			result, err := fn(goja.Undefined(), args(vm, name)...)
+			if err != nil {
+				return nil, jsError(err)
+			}
+			return result, nil
+		}
+	}
+	return nil, fmt.Errorf("js: the script has no function %s", strings.Join(names, " or "))
+}
+
+// memorySampleInterval is the interval of the memory checks of a run.
+const memorySampleInterval = 20 * time.Millisecond
+
+// heapAllocs returns the bytes allocated on the heap since the process started. Unlike
+// runtime.ReadMemStats, reading it does not stop the world.
+func heapAllocs() uint64 {
+	sample := []metrics.Sample{{Name: "/gc/heap/allocs:bytes"}}
+	metrics.Read(sample)
+	if sample[0].Value.Kind() != metrics.KindUint64 {
+		return 0
+	}
+	return sample[0].Value.Uint64()
+}
+
+// watch interrupts the runtime when the run exceeds its time or memory limit.
+func (js *JS) watch(vm *goja.Runtime, done <-chan struct{}) {
+	start := heapAllocs()
+	timeout := time.NewTimer(js.Timeout)
+	defer timeout.Stop()
+	ticker := time.NewTicker(memorySampleInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-timeout.C:
+			vm.Interrupt(fmt.Sprintf("timeout after %v", js.Timeout))
+			return
+		case <-ticker.C:
+			if heapAllocs()-start > js.MaxMemory {
+				vm.Interrupt(fmt.Sprintf("memory limit of %d bytes exceeded", js.MaxMemory))
+				return
+			}
+		}
+	}
+}
+
+func jsError(err error) error {
+	var interrupted *goja.InterruptedError
+	if errors.As(err, &interrupted) {
+		return fmt.Errorf("js: %v", interrupted.Value())
+	}
+	var stackOverflow *goja.StackOverflowError
+	if errors.As(err, &stackOverflow) {
+		return errors.New("js: maximum call stack size exceeded")
+	}
+	return fmt.Errorf("js: %v", err)
+}
+
+// jsResult checks the 'errors' of a TTN codec result and exports it.
+func jsResult(vm goja.Value) (map[string]interface{}, error) {
+	if vm == nil || goja.IsUndefined(vm) || goja.IsNull(vm) {
+		return nil, errors.New("js: the codec returned no result")
+	}
+	result, ok := vm.Export().(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("js: the codec returned %v instead of an object", vm)
+	}
+	if errs, ok := result["errors"].([]interface{}); ok && len(errs) != 0 {
+		msgs := make([]string, len(errs))
+		for i, e := range errs {
+			msgs[i] = fmt.Sprint(e)
+		}
+		return nil, fmt.Errorf("js: %s", strings.Join(msgs, ", "))
+	}
+	return result, nil
+}
+
+// Decode calls 'decodeUplink' (or 'Decode') and returns the decoded data.
+func (js *JS) Decode(fPort uint32, data []byte) (map[string]interface{}, error) {
+	result, err := js.run(func(vm *goja.Runtime, name string) []goja.Value {
+		bytes := make([]interface{}, len(data))
+		for i, b := range data {
+			bytes[i] = b
+		}
+		if name == "Decode" {
+			return []goja.Value{vm.ToValue(fPort), vm.NewArray(bytes...), vm.NewObject()}
+		}
+		input := vm.NewObject()
+		input.Set("bytes", vm.NewArray(bytes...))
+		input.Set("fPort", fPort)
+		if recvTime, err := vm.New(vm.Get("Date"), vm.ToValue(time.Now().UnixMilli())); err == nil {
+			input.Set("recvTime", recvTime)
+		}
+		input.Set("variables", vm.NewObject())
+		return []goja.Value{input}
+	}, "decodeUplink", "Decode")
+	if err != nil {
+		return nil, err
+	}
+	object, err := jsResult(result)
+	if err != nil {
+		return nil, err
+	}
+	// ChirpStack v3 codecs return the decoded object itself, not {data, warnings, errors},
+	// and it may have a 'data' field of its own.
+	_, hasErrors := object["errors"]
+	_, hasWarnings := object["warnings"]
+	if decoded, ok := object["data"].(map[string]interface{}); ok && (hasErrors || hasWarnings) {
+		return decoded, nil
+	}
+	return object, nil
+}
+
+// Encode calls 'encodeDownlink' (or 'Encode') and returns the encoded bytes.
+func (js *JS) Encode(fPort uint32, values map[string]interface{}) ([]byte, error) {
+	result, err := js.run(func(vm *goja.Runtime, name string) []goja.Value {
+		if name == "Encode" {
+			return []goja.Value{vm.ToValue(fPort), vm.ToValue(values), vm.NewObject()}
+		}
+		input := vm.NewObject()
+		input.Set("data", values)
+		input.Set("fPort", fPort)
+		input.Set("variables", vm.NewObject())
+		return []goja.Value{input}
+	}, "encodeDownlink", "Encode")
+	if err != nil {
+		return nil, err
+	}
+	var bytes interface{}
+	if object, ok := result.Export().([]interface{}); ok {
+		// ChirpStack v3 codecs return the bytes array itself.
+		bytes = object
+	} else {
+		object, err := jsResult(result)
+		if err != nil {
+			return nil, err
+		}
+		bytes = object["bytes"]
+	}
+	array, ok := bytes.([]interface{})
+	if !ok {
+		return nil, errors.New("js: the codec returned no bytes")
+	}
+	data := make([]byte, len(array))
+	for i, b := range array {
+		n, err := toFloat(b)
+		if err != nil || n < 0 || n > 255 || n != float64(int(n)) {
+			return nil, fmt.Errorf("js: %v is not a byte", b)
+		}
+		data[i] = byte(n)
+	}
+	return data, nil
+}
@@ -0,0 +1,254 @@
+package codec
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJSDecode(t *testing.T) {
+	tests := []struct {
+		name   string
+		script string
+		values map[string]interface{}
+		err    string
+	}{
+		{
+			"ttn",
+			`function decodeUplink(input) {
+				return {data: {temperature: (input.bytes[0] << 8 | input.bytes[1]) / 10, fPort: input.fPort}, warnings: [], errors: []};
+			}`,
+			map[string]interface{}{"temperature": 21.5, "fPort": int64(2)},
+			"",
+		},
+		{
+			"ttn without warnings and errors",
+			`function decodeUplink(input) {
+				return {data: {temperature: 21.5}};
+			}`,
+			map[string]interface{}{"data": map[string]interface{}{"temperature": 21.5}},
+			"",
+		},
+		{
+			"ttn errors",
+			`function decodeUplink(input) {
+				return {errors: ["unknown port", "too short"]};
+			}`,
+			nil,
+			"js: unknown port, too short",
+		},
+		{
+			"chirpstack v3",
+			`function Decode(fPort, bytes, variables) {
+				return {temperature: (bytes[0] << 8 | bytes[1]) / 10};
+			}`,
+			map[string]interface{}{"temperature": 21.5},
+			"",
+		},
+		{
+			"chirpstack v3 with a data field",
+			`function Decode(fPort, bytes, variables) {
+				return {data: {raw: bytes[0]}, battery: 90};
+			}`,
+			map[string]interface{}{"data": map[string]interface{}{"raw": int64(0)}, "battery": int64(90)},
+			"",
+		},
+		{
+			"no function",
+			`function decode(input) { return {}; }`,
+			nil,
+			"js: the script has no function decodeUplink or Decode",
+		},
+		{
+			"no result",
+			`function decodeUplink(input) {}`,
+			nil,
+			"js: the codec returned no result",
+		},
+		{
+			"exception",
+			`function decodeUplink(input) { throw new Error("broken"); }`,
+			nil,
+			"broken",
+		},
+		{
+			"stack overflow",
+			`function decodeUplink(input) { return decodeUplink(input); }`,
+			nil,
+			"js: maximum call stack size exceeded",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			js, err := NewJS(test.script)
+			if err != nil {
+				t.Fatalf("NewJS: %v", err)
+			}
+			values, err := js.Decode(2, []byte{0x00, 0xD7})
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("Decode error = %v, want %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Decode: %v", err)
+			}
+			if !reflect.DeepEqual(values, test.values) {
+				t.Errorf("Decode = %#v, want %#v", values, test.values)
+			}
+		})
+	}
+}
+
+func TestJSEncode(t *testing.T) {
+	tests := []struct {
+		name   string
+		script string
+		data   []byte
+		err    string
+	}{
+		{
+			"ttn",
+			`function encodeDownlink(input) {
+				return {bytes: [input.fPort, input.data.level], fPort: input.fPort, warnings: [], errors: []};
+			}`,
+			[]byte{2, 50},
+			"",
+		},
+		{
+			"ttn errors",
+			`function encodeDownlink(input) {
+				return {errors: ["level out of range"]};
+			}`,
+			nil,
+			"js: level out of range",
+		},
+		{
+			"chirpstack v3",
+			`function Encode(fPort, obj, variables) {
+				return [obj.level, 0xFF];
+			}`,
+			[]byte{50, 255},
+			"",
+		},
+		{
+			"not a byte",
+			`function Encode(fPort, obj, variables) {
+				return [256];
+			}`,
+			nil,
+			"js: 256 is not a byte",
+		},
+		{
+			"no bytes",
+			`function encodeDownlink(input) {
+				return {fPort: 2};
+			}`,
+			nil,
+			"js: the codec returned no bytes",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			js, err := NewJS(test.script)
+			if err != nil {
+				t.Fatalf("NewJS: %v", err)
+			}
+			data, err := js.Encode(2, map[string]interface{}{"level": 50})
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("Encode error = %v, want %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Encode: %v", err)
+			}
+			if !bytes.Equal(data, test.data) {
+				t.Errorf("Encode = % X, want % X", data, test.data)
+			}
+		})
+	}
+}
+
+func TestJSLimits(t *testing.T) {
+	tests := []struct {
+		name      string
+		script    string
+		timeout   time.Duration
+		maxMemory uint64
+		err       string
+	}{
+		{
+			"timeout",
+			`function decodeUplink(input) { for (;;) {} }`,
+			50 * time.Millisecond,
+			DefaultJSMaxMemory,
+			"js: timeout after 50ms",
+		},
+		{
+			"memory",
+			`function decodeUplink(input) {
+				var list = [];
+				for (;;) { list.push(new Array(1024).fill("x")); }
+			}`,
+			10 * time.Second,
+			1 << 20,
+			"js: memory limit of 1048576 bytes exceeded",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			js, err := NewJS(test.script)
+			if err != nil {
+				t.Fatalf("NewJS: %v", err)
+			}
+			js.Timeout = test.timeout
+			js.MaxMemory = test.maxMemory
+			start := time.Now()
+			_, err = js.Decode(1, nil)
+			if err == nil || err.Error() != test.err {
+				t.Fatalf("Decode error = %v, want %q", err, test.err)
+			}
+			if d := time.Since(start); d > 5*time.Second {
+				t.Errorf("the run was interrupted after %v", d)
+			}
+		})
+	}
+}
+
+func TestNewJSCodec(t *testing.T) {
+	defer func(dir string) { ScriptDir = dir }(ScriptDir)
+	ScriptDir = t.TempDir()
+	tests := []struct {
+		name string
+		spec map[string]interface{}
+		err  string
+	}{
+		{"inline", map[string]interface{}{"type": "js", "script": "function Decode(fPort, bytes) { return {}; }", "timeout": 20}, ""},
+		{"no script", map[string]interface{}{"type": "js"}, "js: no script"},
+		{"script and file", map[string]interface{}{"type": "js", "script": "1", "file": "a.js"}, "js: either 'script' or 'file' must be set, not both"},
+		{"missing file", map[string]interface{}{"type": "js", "file": "missing"}, "missing.js"},
+		{"syntax error", map[string]interface{}{"type": "js", "script": "function ("}, "js: "},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, err := New(test.spec)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("New error = %v, want %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("New: %v", err)
+			}
+			if timeout := c.(*JS).Timeout; timeout != 20*time.Millisecond {
+				t.Errorf("Timeout = %v, want 20ms", timeout)
+			}
+		})
+	}
+}
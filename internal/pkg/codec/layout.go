@@ -0,0 +1,178 @@
+package codec
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Layout is a declarative byte layout codec: each field is a number at a fixed
+// offset of the payload. Numbers are big-endian unless 'littleEndian' is set.
+//
+//	{
+//	  "type": "layout",
+//	  "fields": [
+//	    {"name": "temperature", "type": "int16", "scale": 0.1},
+//	    {"name": "humidity", "type": "uint8"},
+//	    {"name": "alarm", "type": "bool", "offset": 3, "bit": 0}
+//	  ]
+//	}
+type Layout struct {
+	Fields []LayoutField `json:"fields"`
+}
+
+// LayoutField is a number or bool of a Layout.
+type LayoutField struct {
+	Name string `json:"name"`
+	// Type is one of uint8, int8, uint16, int16, uint24, int24, uint32, int32,
+	// float32, float64 or bool.
+	Type string `json:"type"`
+	// Offset in bytes. The default is the end of the previous field.
+	Offset *int `json:"offset,omitempty"`
+	// LittleEndian byte order for multi-byte integers and floats.
+	LittleEndian bool `json:"littleEndian,omitempty"`
+	// Scale is the resolution of an integer (value = raw * scale). Default 1.
+	Scale float64 `json:"scale,omitempty"`
+	// Bit of a bool (0 is the least significant bit). Without a bit, any non-zero byte is true.
+	Bit *int `json:"bit,omitempty"`
+}
+
+var layoutTypeSizes = map[string]int{
+	"uint8": 1, "int8": 1,
+	"uint16": 2, "int16": 2,
+	"uint24": 3, "int24": 3,
+	"uint32": 4, "int32": 4,
+	"float32": 4, "float64": 8,
+	"bool": 1,
+}
+
+func newLayout(options []byte) (*Layout, error) {
+	var layout Layout
+	if err := json.Unmarshal(options, &layout); err != nil {
+		return nil, fmt.Errorf("layout: %v", err)
+	}
+	if len(layout.Fields) == 0 {
+		return nil, errors.New("layout: no fields")
+	}
+	offset := 0
+	for i := range layout.Fields {
+		f := &layout.Fields[i]
+		size := layoutTypeSizes[f.Type]
+		if f.Name == "" {
+			return nil, fmt.Errorf("layout: field %d has no name", i)
+		}
+		if size == 0 {
+			return nil, fmt.Errorf("layout: %s: unknown type %q", f.Name, f.Type)
+		}
+		if f.Bit != nil && (f.Type != "bool" || *f.Bit < 0 || *f.Bit > 7) {
+			return nil, fmt.Errorf("layout: %s: invalid bit", f.Name)
+		}
+		if f.Offset == nil {
+			f.Offset = new(int)
+			*f.Offset = offset
+		} else if *f.Offset < 0 {
+			return nil, fmt.Errorf("layout: %s: invalid offset", f.Name)
+		}
+		if f.Scale == 0 {
+			f.Scale = 1
+		}
+		offset = *f.Offset + size
+	}
+	return &layout, nil
+}
+
+func (f *LayoutField) bytes(data []byte) []byte {
+	b := make([]byte, len(data))
+	copy(b, data)
+	if f.LittleEndian {
+		for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+			b[i], b[j] = b[j], b[i]
+		}
+	}
+	return b
+}
+
+// Decode reads all fields of the payload, regardless of the fPort.
+func (layout *Layout) Decode(fPort uint32, data []byte) (map[string]interface{}, error) {
+	values := make(map[string]interface{}, len(layout.Fields))
+	for _, f := range layout.Fields {
+		size := layoutTypeSizes[f.Type]
+		if *f.Offset+size > len(data) {
+			return nil, fmt.Errorf("layout: %s: the payload is too short (%d bytes)", f.Name, len(data))
+		}
+		b := f.bytes(data[*f.Offset : *f.Offset+size])
+		switch f.Type {
+		case "bool":
+			if f.Bit != nil {
+				values[f.Name] = b[0]&(1<<*f.Bit) != 0
+			} else {
+				values[f.Name] = b[0] != 0
+			}
+		case "float32":
+			values[f.Name] = float64(math.Float32frombits(binary.BigEndian.Uint32(b))) * f.Scale
+		case "float64":
+			values[f.Name] = math.Float64frombits(binary.BigEndian.Uint64(b)) * f.Scale
+		case "int8", "int16", "int24", "int32":
+			values[f.Name] = scale(float64(readInt(b)), f.Scale)
+		default:
+			values[f.Name] = scale(float64(readUint(b)), f.Scale)
+		}
+	}
+	return values, nil
+}
+
+// Encode writes the fields with a value, leaving the bytes of missing values zero.
+func (layout *Layout) Encode(fPort uint32, values map[string]interface{}) ([]byte, error) {
+	length := 0
+	for _, f := range layout.Fields {
+		if _, ok := values[f.Name]; ok && *f.Offset+layoutTypeSizes[f.Type] > length {
+			length = *f.Offset + layoutTypeSizes[f.Type]
+		}
+	}
+	data := make([]byte, length)
+	for _, f := range layout.Fields {
+		value, ok := values[f.Name]
+		if !ok {
+			continue
+		}
+		b := make([]byte, layoutTypeSizes[f.Type])
+		switch f.Type {
+		case "bool":
+			n, err := toFloat(value)
+			if err != nil {
+				return nil, fmt.Errorf("layout: %s: %v", f.Name, err)
+			}
+			if n != 0 {
+				if f.Bit != nil {
+					b[0] = 1 << *f.Bit
+				} else {
+					b[0] = 1
+				}
+			}
+		case "float32", "float64":
+			n, err := toFloat(value)
+			if err != nil {
+				return nil, fmt.Errorf("layout: %s: %v", f.Name, err)
+			}
+			if f.Type == "float32" {
+				binary.BigEndian.PutUint32(b, math.Float32bits(float32(n/f.Scale)))
+			} else {
+				binary.BigEndian.PutUint64(b, math.Float64bits(n/f.Scale))
+			}
+		default:
+			signed := f.Type[0] == 'i'
+			n, err := scaleInt(value, len(b), f.Scale, signed)
+			if err != nil {
+				return nil, fmt.Errorf("layout: %s: %v", f.Name, err)
+			}
+			writeInt(b, n)
+		}
+		b = f.bytes(b)
+		for i := range b {
+			data[*f.Offset+i] |= b[i]
+		}
+	}
+	return data, nil
+}
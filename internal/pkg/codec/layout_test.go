@@ -0,0 +1,116 @@
+package codec
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestLayout(t *testing.T) {
+	tests := []struct {
+		name   string
+		spec   map[string]interface{}
+		data   []byte
+		values map[string]interface{}
+	}{
+		{
+			"fields one after the other",
+			map[string]interface{}{"type": "layout", "fields": []interface{}{
+				map[string]interface{}{"name": "temperature", "type": "int16", "scale": 0.1},
+				map[string]interface{}{"name": "humidity", "type": "uint8"},
+				map[string]interface{}{"name": "alarm", "type": "bool", "bit": 0},
+			}},
+			[]byte{0xFF, 0x38, 0x37, 0x01},
+			map[string]interface{}{"temperature": -20.0, "humidity": 55.0, "alarm": true},
+		},
+		{
+			"bits of one byte",
+			map[string]interface{}{"type": "layout", "fields": []interface{}{
+				map[string]interface{}{"name": "open", "type": "bool", "offset": 0, "bit": 0},
+				map[string]interface{}{"name": "locked", "type": "bool", "offset": 0, "bit": 7},
+			}},
+			[]byte{0x80},
+			map[string]interface{}{"open": false, "locked": true},
+		},
+		{
+			"little endian",
+			map[string]interface{}{"type": "layout", "fields": []interface{}{
+				map[string]interface{}{"name": "counter", "type": "uint16", "littleEndian": true},
+				map[string]interface{}{"name": "offset", "type": "int24", "littleEndian": true},
+			}},
+			[]byte{0x34, 0x12, 0xFE, 0xFF, 0xFF},
+			map[string]interface{}{"counter": 4660.0, "offset": -2.0},
+		},
+		{
+			"floats",
+			map[string]interface{}{"type": "layout", "fields": []interface{}{
+				map[string]interface{}{"name": "level", "type": "float32"},
+				map[string]interface{}{"name": "flow", "type": "float64"},
+			}},
+			[]byte{0x3F, 0xC0, 0x00, 0x00, 0xC0, 0x04, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00},
+			map[string]interface{}{"level": 1.5, "flow": -2.5},
+		},
+		{
+			"uint32 with offset",
+			map[string]interface{}{"type": "layout", "fields": []interface{}{
+				map[string]interface{}{"name": "energy", "type": "uint32", "offset": 2, "scale": 0.001},
+			}},
+			[]byte{0x00, 0x00, 0x00, 0x01, 0xE2, 0x40},
+			map[string]interface{}{"energy": 123.456},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, err := New(test.spec)
+			if err != nil {
+				t.Fatalf("New: %v", err)
+			}
+			values, err := c.Decode(1, test.data)
+			if err != nil {
+				t.Fatalf("Decode: %v", err)
+			}
+			if !reflect.DeepEqual(values, test.values) {
+				t.Errorf("Decode = %v, want %v", values, test.values)
+			}
+			data, err := c.Encode(1, test.values)
+			if err != nil {
+				t.Fatalf("Encode: %v", err)
+			}
+			if !bytes.Equal(data, test.data) {
+				t.Errorf("Encode = % X, want % X", data, test.data)
+			}
+		})
+	}
+}
+
+func TestLayoutErrors(t *testing.T) {
+	specs := []struct {
+		name   string
+		fields []interface{}
+	}{
+		{"no fields", []interface{}{}},
+		{"no name", []interface{}{map[string]interface{}{"type": "uint8"}}},
+		{"unknown type", []interface{}{map[string]interface{}{"name": "a", "type": "uint12"}}},
+		{"bit of an integer", []interface{}{map[string]interface{}{"name": "a", "type": "uint8", "bit": 1}}},
+		{"bit out of range", []interface{}{map[string]interface{}{"name": "a", "type": "bool", "bit": 8}}},
+		{"negative offset", []interface{}{map[string]interface{}{"name": "a", "type": "uint8", "offset": -1}}},
+	}
+	for _, test := range specs {
+		if _, err := New(map[string]interface{}{"type": "layout", "fields": test.fields}); err == nil {
+			t.Errorf("New %s: no error", test.name)
+		}
+	}
+
+	c, err := New(map[string]interface{}{"type": "layout", "fields": []interface{}{
+		map[string]interface{}{"name": "temperature", "type": "int16", "scale": 0.1},
+	}})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if _, err := c.Decode(1, []byte{0x01}); err == nil {
+		t.Errorf("Decode of a short payload: no error")
+	}
+	if _, err := c.Encode(1, map[string]interface{}{"temperature": 4000.0}); err == nil {
+		t.Errorf("Encode out of range: no error")
+	}
+}
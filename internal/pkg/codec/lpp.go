@@ -0,0 +1,319 @@
+package codec
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// LPP is a Cayenne Low Power Payload codec. A payload is a list of values, each
+// with a channel and a data type. The values are named '<type>_<channel>', for
+// example 'temperature_3'. Types with more than one field, like 'gps', have an
+// object value.
+type LPP struct {
+	types  map[byte]*lppType
+	byName map[string]*lppType
+	// extended enables the XLPP integer, string, bool, binary and null types.
+	extended bool
+}
+
+type lppType struct {
+	id     byte
+	name   string
+	fields []lppField
+}
+
+type lppField struct {
+	name   string
+	size   int
+	scale  float64
+	signed bool
+}
+
+// XLPP data types, in addition to the LPP types.
+const (
+	xlppInteger   = 51
+	xlppString    = 52
+	xlppBool      = 53
+	xlppBoolTrue  = 54
+	xlppBoolFalse = 55
+	xlppBinary    = 57
+	xlppNull      = 58
+)
+
+var xlppTypeNames = map[byte]string{
+	xlppInteger:   "integer",
+	xlppString:    "string",
+	xlppBool:      "bool",
+	xlppBoolTrue:  "bool",
+	xlppBoolFalse: "bool",
+	xlppBinary:    "binary",
+	xlppNull:      "null",
+}
+
+func scalar(id byte, name string, size int, scale float64, signed bool) *lppType {
+	return &lppType{id, name, []lppField{{"", size, scale, signed}}}
+}
+
+func vector(id byte, name string, fields ...lppField) *lppType {
+	return &lppType{id, name, fields}
+}
+
+// cayenneTypes are the data types of the original Cayenne LPP.
+var cayenneTypes = []*lppType{
+	scalar(0, "digitalInput", 1, 1, false),
+	scalar(1, "digitalOutput", 1, 1, false),
+	scalar(2, "analogInput", 2, 0.01, true),
+	scalar(3, "analogOutput", 2, 0.01, true),
+	scalar(101, "illuminance", 2, 1, false),
+	scalar(102, "presence", 1, 1, false),
+	scalar(103, "temperature", 2, 0.1, true),
+	scalar(104, "humidity", 1, 0.5, false),
+	vector(113, "accelerometer", lppField{"x", 2, 0.001, true}, lppField{"y", 2, 0.001, true}, lppField{"z", 2, 0.001, true}),
+	scalar(115, "barometer", 2, 0.1, false),
+	vector(134, "gyrometer", lppField{"x", 2, 0.01, true}, lppField{"y", 2, 0.01, true}, lppField{"z", 2, 0.01, true}),
+	vector(136, "gps", lppField{"latitude", 3, 0.0001, true}, lppField{"longitude", 3, 0.0001, true}, lppField{"altitude", 3, 0.01, true}),
+}
+
+// xlppTypes are the LPP data types added by XLPP.
+var xlppTypes = []*lppType{
+	scalar(100, "genericSensor", 4, 1, false),
+	scalar(116, "voltage", 2, 0.01, false),
+	scalar(117, "current", 2, 0.001, false),
+	scalar(118, "frequency", 4, 1, false),
+	scalar(120, "percentage", 1, 1, false),
+	scalar(121, "altitude", 2, 1, true),
+	scalar(125, "concentration", 2, 1, false),
+	scalar(128, "power", 2, 1, false),
+	scalar(130, "distance", 4, 0.001, false),
+	scalar(131, "energy", 4, 0.001, false),
+	scalar(132, "direction", 2, 1, false),
+	scalar(133, "unixTime", 4, 1, false),
+	vector(135, "colour", lppField{"r", 1, 1, false}, lppField{"g", 1, 1, false}, lppField{"b", 1, 1, false}),
+	scalar(142, "switch", 1, 1, false),
+}
+
+// CayenneLPP is the Cayenne Low Power Payload codec.
+var CayenneLPP = newLPP(false, cayenneTypes)
+
+// XLPP is the Waziup extended Low Power Payload codec, which adds more sensor
+// types and integer, string, bool, binary and null values to Cayenne LPP.
+var XLPP = newLPP(true, cayenneTypes, xlppTypes)
+
+func newLPP(extended bool, typeSets ...[]*lppType) *LPP {
+	lpp := &LPP{
+		types:    make(map[byte]*lppType),
+		byName:   make(map[string]*lppType),
+		extended: extended,
+	}
+	for _, types := range typeSets {
+		for _, t := range types {
+			lpp.types[t.id] = t
+			lpp.byName[t.name] = t
+		}
+	}
+	return lpp
+}
+
+// Decode decodes all values of the payload, regardless of the fPort.
+func (lpp *LPP) Decode(fPort uint32, data []byte) (map[string]interface{}, error) {
+	values := make(map[string]interface{})
+	for len(data) != 0 {
+		if len(data) < 2 {
+			return nil, errors.New("lpp: unexpected end of payload")
+		}
+		channel, id := data[0], data[1]
+		data = data[2:]
+
+		var name string
+		var value interface{}
+		var err error
+		if t := lpp.types[id]; t != nil {
+			name = t.name
+			value, data, err = t.decode(data)
+		} else if lpp.extended && xlppTypeNames[id] != "" {
+			name = xlppTypeNames[id]
+			value, data, err = decodeXLPP(id, data)
+		} else {
+			return nil, fmt.Errorf("lpp: unknown data type %d on channel %d", id, channel)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("lpp: %s on channel %d: %v", name, channel, err)
+		}
+		values[name+"_"+strconv.Itoa(int(channel))] = value
+	}
+	return values, nil
+}
+
+func (t *lppType) decode(data []byte) (interface{}, []byte, error) {
+	if len(t.fields) == 1 {
+		f := t.fields[0]
+		if len(data) < f.size {
+			return nil, nil, errors.New("unexpected end of payload")
+		}
+		return f.decode(data[:f.size]), data[f.size:], nil
+	}
+	value := make(map[string]interface{}, len(t.fields))
+	for _, f := range t.fields {
+		if len(data) < f.size {
+			return nil, nil, errors.New("unexpected end of payload")
+		}
+		value[f.name] = f.decode(data[:f.size])
+		data = data[f.size:]
+	}
+	return value, data, nil
+}
+
+func (f lppField) decode(data []byte) float64 {
+	var n float64
+	if f.signed {
+		n = float64(readInt(data))
+	} else {
+		n = float64(readUint(data))
+	}
+	return scale(n, f.scale)
+}
+
+func decodeXLPP(id byte, data []byte) (interface{}, []byte, error) {
+	switch id {
+	case xlppInteger:
+		n, size := binary.Varint(data)
+		if size <= 0 {
+			return nil, nil, errors.New("invalid varint")
+		}
+		return n, data[size:], nil
+	case xlppString:
+		for i, b := range data {
+			if b == 0 {
+				return string(data[:i]), data[i+1:], nil
+			}
+		}
+		return nil, nil, errors.New("unterminated string")
+	case xlppBool:
+		if len(data) < 1 {
+			return nil, nil, errors.New("unexpected end of payload")
+		}
+		return data[0] != 0, data[1:], nil
+	case xlppBoolTrue:
+		return true, data, nil
+	case xlppBoolFalse:
+		return false, data, nil
+	case xlppBinary:
+		n, size := binary.Uvarint(data)
+		if size <= 0 || uint64(len(data)-size) < n {
+			return nil, nil, errors.New("invalid length")
+		}
+		data = data[size:]
+		return base64.StdEncoding.EncodeToString(data[:n]), data[n:], nil
+	default: // xlppNull
+		return nil, data, nil
+	}
+}
+
+// Encode encodes the values, named '<type>_<channel>', in the order of their names.
+func (lpp *LPP) Encode(fPort uint32, values map[string]interface{}) ([]byte, error) {
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var data []byte
+	for _, name := range names {
+		i := strings.LastIndexByte(name, '_')
+		if i == -1 {
+			return nil, fmt.Errorf("lpp: %q is not named '<type>_<channel>'", name)
+		}
+		channel, err := strconv.ParseUint(name[i+1:], 10, 8)
+		if err != nil {
+			return nil, fmt.Errorf("lpp: %q has an invalid channel", name)
+		}
+		value := values[name]
+		if t := lpp.byName[name[:i]]; t != nil {
+			data = append(data, byte(channel), t.id)
+			data, err = t.encode(data, value)
+		} else if lpp.extended {
+			data, err = encodeXLPP(data, byte(channel), name[:i], value)
+		} else {
+			err = fmt.Errorf("unknown data type %q", name[:i])
+		}
+		if err != nil {
+			return nil, fmt.Errorf("lpp: %s: %v", name, err)
+		}
+	}
+	return data, nil
+}
+
+func (t *lppType) encode(data []byte, value interface{}) ([]byte, error) {
+	if len(t.fields) == 1 {
+		return t.fields[0].encode(data, value)
+	}
+	m, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%v is not an object", value)
+	}
+	var err error
+	for _, f := range t.fields {
+		if data, err = f.encode(data, m[f.name]); err != nil {
+			return nil, fmt.Errorf("%s: %v", f.name, err)
+		}
+	}
+	return data, nil
+}
+
+func (f lppField) encode(data []byte, value interface{}) ([]byte, error) {
+	n, err := scaleInt(value, f.size, f.scale, f.signed)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, f.size)
+	writeInt(buf, n)
+	return append(data, buf...), nil
+}
+
+func encodeXLPP(data []byte, channel byte, typ string, value interface{}) ([]byte, error) {
+	switch typ {
+	case "integer":
+		f, err := toFloat(value)
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, channel, xlppInteger)
+		return binary.AppendVarint(data, int64(f)), nil
+	case "string":
+		s, ok := value.(string)
+		if !ok || strings.IndexByte(s, 0) != -1 {
+			return nil, fmt.Errorf("%v is not a string", value)
+		}
+		data = append(data, channel, xlppString)
+		return append(append(data, s...), 0), nil
+	case "bool":
+		b, ok := value.(bool)
+		if !ok {
+			return nil, fmt.Errorf("%v is not a bool", value)
+		}
+		if b {
+			return append(data, channel, xlppBoolTrue), nil
+		}
+		return append(data, channel, xlppBoolFalse), nil
+	case "binary":
+		s, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("%v is not a base64 string", value)
+		}
+		b, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, channel, xlppBinary)
+		return append(binary.AppendUvarint(data, uint64(len(b))), b...), nil
+	case "null":
+		return append(data, channel, xlppNull), nil
+	default:
+		return nil, fmt.Errorf("unknown data type %q", typ)
+	}
+}
@@ -0,0 +1,136 @@
+package codec
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestLPP(t *testing.T) {
+	tests := []struct {
+		name   string
+		lpp    *LPP
+		data   []byte
+		values map[string]interface{}
+	}{
+		{
+			"temperature",
+			CayenneLPP,
+			[]byte{0x03, 0x67, 0x01, 0x10},
+			map[string]interface{}{"temperature_3": 27.2},
+		},
+		{
+			"humidity and negative temperature, encoded in the order of the names",
+			CayenneLPP,
+			[]byte{0x05, 0x68, 0x80, 0x01, 0x67, 0xFF, 0xD7},
+			map[string]interface{}{"temperature_1": -4.1, "humidity_5": 64.0},
+		},
+		{
+			"gps",
+			CayenneLPP,
+			[]byte{0x01, 0x88, 0x06, 0x76, 0x5F, 0xF2, 0x96, 0x0A, 0x00, 0x03, 0xE8},
+			map[string]interface{}{"gps_1": map[string]interface{}{"latitude": 42.3519, "longitude": -87.9094, "altitude": 10.0}},
+		},
+		{
+			"digital output",
+			CayenneLPP,
+			[]byte{0x02, 0x01, 0x01},
+			map[string]interface{}{"digitalOutput_2": 1.0},
+		},
+		{
+			"xlpp voltage",
+			XLPP,
+			[]byte{0x04, 0x74, 0x01, 0x4A},
+			map[string]interface{}{"voltage_4": 3.3},
+		},
+		{
+			"xlpp integer",
+			XLPP,
+			[]byte{0x02, 0x33, 0x05},
+			map[string]interface{}{"integer_2": int64(-3)},
+		},
+		{
+			"xlpp string",
+			XLPP,
+			[]byte{0x01, 0x34, 'h', 'i', 0x00},
+			map[string]interface{}{"string_1": "hi"},
+		},
+		{
+			"xlpp bools",
+			XLPP,
+			[]byte{0x01, 0x36, 0x02, 0x37},
+			map[string]interface{}{"bool_1": true, "bool_2": false},
+		},
+		{
+			"xlpp binary",
+			XLPP,
+			[]byte{0x01, 0x39, 0x02, 0x01, 0x02},
+			map[string]interface{}{"binary_1": "AQI="},
+		},
+		{
+			"xlpp null",
+			XLPP,
+			[]byte{0x07, 0x3A},
+			map[string]interface{}{"null_7": nil},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			values, err := test.lpp.Decode(1, test.data)
+			if err != nil {
+				t.Fatalf("Decode: %v", err)
+			}
+			if !reflect.DeepEqual(values, test.values) {
+				t.Errorf("Decode = %v, want %v", values, test.values)
+			}
+			data, err := test.lpp.Encode(1, test.values)
+			if err != nil {
+				t.Fatalf("Encode: %v", err)
+			}
+			if !bytes.Equal(data, test.data) {
+				t.Errorf("Encode = % X, want % X", data, test.data)
+			}
+		})
+	}
+}
+
+func TestLPPErrors(t *testing.T) {
+	decodeTests := []struct {
+		name string
+		lpp  *LPP
+		data []byte
+	}{
+		{"truncated header", CayenneLPP, []byte{0x01}},
+		{"truncated value", CayenneLPP, []byte{0x01, 0x67, 0x01}},
+		{"truncated gps", CayenneLPP, []byte{0x01, 0x88, 0x06, 0x76, 0x5F}},
+		{"xlpp type in cayenne", CayenneLPP, []byte{0x01, 0x74, 0x01, 0x4A}},
+		{"unknown type", XLPP, []byte{0x01, 0xFF}},
+		{"unterminated string", XLPP, []byte{0x01, 0x34, 'h', 'i'}},
+		{"binary too long", XLPP, []byte{0x01, 0x39, 0x03, 0x01}},
+	}
+	for _, test := range decodeTests {
+		if _, err := test.lpp.Decode(1, test.data); err == nil {
+			t.Errorf("Decode %s: no error", test.name)
+		}
+	}
+
+	encodeTests := []struct {
+		name   string
+		lpp    *LPP
+		values map[string]interface{}
+	}{
+		{"no channel", CayenneLPP, map[string]interface{}{"temperature": 21.0}},
+		{"invalid channel", CayenneLPP, map[string]interface{}{"temperature_256": 21.0}},
+		{"unknown type", CayenneLPP, map[string]interface{}{"string_1": "hi"}},
+		{"out of range", CayenneLPP, map[string]interface{}{"humidity_1": 128.0}},
+		{"not a number", CayenneLPP, map[string]interface{}{"temperature_1": "warm"}},
+		{"gps not an object", CayenneLPP, map[string]interface{}{"gps_1": 1.0}},
+		{"string with zero", XLPP, map[string]interface{}{"string_1": "a\x00b"}},
+		{"invalid binary", XLPP, map[string]interface{}{"binary_1": "!"}},
+	}
+	for _, test := range encodeTests {
+		if _, err := test.lpp.Encode(1, test.values); err == nil {
+			t.Errorf("Encode %s: no error", test.name)
+		}
+	}
+}
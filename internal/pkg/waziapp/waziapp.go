@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"net/http"
@@ -71,6 +72,41 @@ func logHints() {
 
 const HealthcheckPath = "/healtcheck"
 
+// Get calls the API of the running WaziApp through its 'proxy.sock' file and
+// copies the response body to w.
+func Get(url string, w io.Writer) error {
+	proxySock := path.Join(Dir, "proxy.sock")
+	transport := &http.Transport{
+		DialContext: func(_ context.Context, _, _ string) (net.Conn, error) {
+			return net.Dial("unix", proxySock)
+		},
+		DisableKeepAlives: true,
+	}
+	client := http.Client{
+		Transport: transport,
+	}
+	defer client.CloseIdleConnections()
+
+	req, err := http.NewRequest(http.MethodGet, "http://localhost"+url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", "WaziApp")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		text, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("unexpected status code: %d %s", resp.StatusCode, text)
+	}
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
 func Healtcheck() error {
 	proxySock := path.Join(Dir, "proxy.sock")
 	conn, err := net.Dial("unix", proxySock)
@@ -53,10 +53,46 @@ func AddSensorValue(deviceID string, sensorID string, value interface{}) error {
 	return conn.AddSensorValue(deviceID, sensorID, value)
 }
 
+func AddSensorValues(deviceID string, sensorID string, values []waziup.Value) error {
+	return conn.AddSensorValues(deviceID, sensorID, values)
+}
+
 func AddSensor(deviceID string, sensor *waziup.Sensor) error {
 	return conn.AddSensor(deviceID, sensor)
 }
 
+func AddActuatorValue(deviceID string, actuatorID string, value interface{}) error {
+	return conn.AddActuatorValue(deviceID, actuatorID, value)
+}
+
+func AddActuatorValues(deviceID string, actuatorID string, values []waziup.Value) error {
+	return conn.AddActuatorValues(deviceID, actuatorID, values)
+}
+
+func AddActuator(deviceID string, actuator *waziup.Actuator) error {
+	return conn.AddActuator(deviceID, actuator)
+}
+
+func GetActuatorMeta(deviceID string, actuatorID string) (waziup.Meta, error) {
+	return conn.GetActuatorMeta(deviceID, actuatorID)
+}
+
+func SetActuatorMeta(deviceID string, actuatorID string, meta waziup.Meta) error {
+	return conn.SetActuatorMeta(deviceID, actuatorID, meta)
+}
+
+func AddDevice(device *waziup.Device) error {
+	return conn.AddDevice(device)
+}
+
+func GetDevice(deviceID string) (*waziup.Device, error) {
+	return conn.GetDevice(deviceID)
+}
+
+func SetMeta(deviceID string, meta waziup.Meta) error {
+	return conn.SetMeta(deviceID, meta)
+}
+
 func GetDevices(query *waziup.DevicesQuery) (devices []waziup.Device, err error) {
 	return conn.GetDevices(query)
 }
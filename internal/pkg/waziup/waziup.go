@@ -53,6 +53,12 @@ type Sensor struct {
 	Meta     Meta        `json:"meta" bson:"meta"`
 }
 
+// Value is a sensor or actuator value with the time it was measured.
+type Value struct {
+	Value interface{} `json:"value" bson:"value"`
+	Time  time.Time   `json:"time" bson:"time"`
+}
+
 // Actuator represents a Waziup actuator
 type Actuator struct {
 	ID       string      `json:"id" bson:"id"`
@@ -107,7 +113,12 @@ func (w *Waziup) Get(res string, o interface{}) error {
 	if !resp.OK {
 		text, _ := resp.Text()
 		log.Println(text)
-		return fmt.Errorf("fetch: %s", resp.StatusText)
+		return &Error{
+			URL:        res,
+			Status:     resp.Status,
+			StatusText: resp.StatusText,
+			Text:       text,
+		}
 	}
 	contentType := resp.Headers.Get("Content-Type")
 	if o == nil {
@@ -143,6 +154,24 @@ func IsNotExist(err error) bool {
 	return false
 }
 
+// IsUnreachable tells if the API could not be reached or is temporarily unavailable.
+func IsUnreachable(err error) bool {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Status == -1 || e.Status >= 500
+	}
+	return false
+}
+
+// IsOffline tells if the API could not be reached at all.
+func IsOffline(err error) bool {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Status == -1
+	}
+	return false
+}
+
 // Set queries an API endpoint to write data.
 func (w *Waziup) Set(res string, i interface{}, o interface{}) error {
 	body, err := json.Marshal(i)
@@ -198,6 +227,11 @@ func (w *Waziup) AddSensorValue(deviceID string, sensorID string, value interfac
 	return w.Set("devices/"+deviceID+"/sensors/"+sensorID+"/value", value, nil)
 }
 
+// AddSensorValues uploads sensor values with their time.
+func (w *Waziup) AddSensorValues(deviceID string, sensorID string, values []Value) error {
+	return w.Set("devices/"+deviceID+"/sensors/"+sensorID+"/values", values, nil)
+}
+
 func (w *Waziup) UnmarshalDevice(deviceID string, data []byte) error {
 	resp := fetch.Fetch(w.ToURL("devices/"+deviceID), &fetch.FetchInit{
 		Method: "POST",
@@ -208,7 +242,12 @@ func (w *Waziup) UnmarshalDevice(deviceID string, data []byte) error {
 	})
 	text, _ := resp.Text()
 	if !resp.OK {
-		return fmt.Errorf("UnmarshalDevice: Err %d: %s %s", resp.Status, resp.StatusText, text)
+		return &Error{
+			URL:        "devices/" + deviceID,
+			Status:     resp.Status,
+			StatusText: resp.StatusText,
+			Text:       text,
+		}
 	}
 	if text != "" {
 		log.Printf("UnmarshalDevice: Server says %q", text)
@@ -230,10 +269,51 @@ func (w *Waziup) MarshalDevice(deviceID string) ([]byte, error) {
 	return data, nil
 }
 
+// AddDevice creates a new device. The device ID is set from the response.
+func (w *Waziup) AddDevice(device *Device) error {
+	return w.Set("devices", device, &device.ID)
+}
+
+// SetMeta sets metadata keys of a device.
+func (w *Waziup) SetMeta(deviceID string, meta Meta) error {
+	return w.Set("devices/"+deviceID+"/meta", meta, nil)
+}
+
+// GetDevice queries a single device.
+func (w *Waziup) GetDevice(deviceID string) (device *Device, err error) {
+	err = w.Get("devices/"+deviceID, &device)
+	return
+}
+
 func (w *Waziup) AddSensor(deviceID string, sensor *Sensor) error {
 	return w.Set("devices/"+deviceID+"/sensors", sensor, &sensor.ID)
 }
 
+// AddActuatorValue uploads a new actuator value.
+func (w *Waziup) AddActuatorValue(deviceID string, actuatorID string, value interface{}) error {
+	return w.Set("devices/"+deviceID+"/actuators/"+actuatorID+"/value", value, nil)
+}
+
+// AddActuatorValues uploads actuator values with their time.
+func (w *Waziup) AddActuatorValues(deviceID string, actuatorID string, values []Value) error {
+	return w.Set("devices/"+deviceID+"/actuators/"+actuatorID+"/values", values, nil)
+}
+
+func (w *Waziup) AddActuator(deviceID string, actuator *Actuator) error {
+	return w.Set("devices/"+deviceID+"/actuators", actuator, &actuator.ID)
+}
+
+// GetActuatorMeta returns the metadata of an actuator.
+func (w *Waziup) GetActuatorMeta(deviceID string, actuatorID string) (meta Meta, err error) {
+	err = w.Get("devices/"+deviceID+"/actuators/"+actuatorID+"/meta", &meta)
+	return
+}
+
+// SetActuatorMeta sets the metadata of an actuator.
+func (w *Waziup) SetActuatorMeta(deviceID string, actuatorID string, meta Meta) error {
+	return w.Set("devices/"+deviceID+"/actuators/"+actuatorID+"/meta", meta, nil)
+}
+
 // GetDevices queries all devices.
 func (w *Waziup) GetDevices(query *DevicesQuery) (devices []Device, err error) {
 	res := "devices"
@@ -320,6 +400,16 @@ type JSON struct {
 	value interface{}
 }
 
+// NewJSON wraps a decoded JSON value.
+func NewJSON(value interface{}) JSON {
+	return JSON{value: value}
+}
+
+// Value returns the decoded JSON value.
+func (json JSON) Value() interface{} {
+	return json.value
+}
+
 func (json JSON) Get(key string) JSON {
 	if json.value == nil {
 		return JSON{}
@@ -367,3 +457,14 @@ func (json JSON) Int() (int, error) {
 	}
 	return int(n), nil
 }
+
+func (json JSON) Bool() (bool, error) {
+	if json.value == nil {
+		return false, errNoValue
+	}
+	b, ok := json.value.(bool)
+	if !ok {
+		return false, errNoValue
+	}
+	return b, nil
+}